@@ -0,0 +1,198 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessAction is what an AccessRule does with connections it matches.
+type AccessAction int
+
+const (
+	// AccessAllow accepts connections.
+	AccessAllow AccessAction = iota
+
+	// AccessDeny refuses connections with the rule's reply.
+	AccessDeny
+
+	// AccessTrust accepts connections, and allows them to relay mail without
+	// authenticating.
+	AccessTrust
+)
+
+func (a AccessAction) String() string {
+	switch a {
+	case AccessAllow:
+		return "allow"
+	case AccessDeny:
+		return "deny"
+	case AccessTrust:
+		return "trust"
+	}
+
+	return "unknown"
+}
+
+// An AccessRule applies an AccessAction to connections from a network.
+type AccessRule struct {
+	Network *net.IPNet
+	Action  AccessAction
+
+	// Reply is sent to connections that are denied. If empty a 554 reply is
+	// used.
+	Reply string
+}
+
+// An AccessPolicy decides which clients may connect to a Server, by their
+// address. Rules are checked in order and the first whose Network contains the
+// client's address applies; clients matching no rule are allowed. The rules can
+// be replaced while the Server is running.
+type AccessPolicy struct {
+	mu    sync.RWMutex
+	rules []AccessRule
+}
+
+// NewAccessPolicy returns an AccessPolicy with the rules given.
+func NewAccessPolicy(rules []AccessRule) *AccessPolicy {
+	return &AccessPolicy{rules: rules}
+}
+
+// SetRules replaces the rules of the AccessPolicy. Connections already
+// accepted are not affected.
+func (p *AccessPolicy) SetRules(rules []AccessRule) {
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+}
+
+// Rules returns the rules of the AccessPolicy.
+func (p *AccessPolicy) Rules() []AccessRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]AccessRule(nil), p.rules...)
+}
+
+// match returns the rule that applies to a client at ip.
+func (p *AccessPolicy) match(ip net.IP) AccessRule {
+	if p == nil || ip == nil {
+		return AccessRule{}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, rule := range p.rules {
+		if rule.Network.Contains(ip) {
+			return rule
+		}
+	}
+
+	return AccessRule{}
+}
+
+// ParseAccessRules reads rules, one to a line, in the form
+//
+//	deny 192.0.2.0/24 554 5.7.1 Go away
+//	trust 2001:db8::/32
+//	allow 198.51.100.7
+//
+// where the action is one of allow, deny or trust, and a deny may be followed
+// by the reply to send, which must start with a 5xx code. A single address is
+// a network of that address alone.
+// Blank lines, and lines starting with #, are ignored.
+func ParseAccessRules(r io.Reader) ([]AccessRule, error) {
+	var rules []AccessRule
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("access: line %d: missing network", n)
+		}
+
+		var rule AccessRule
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			rule.Action = AccessAllow
+		case "deny":
+			rule.Action = AccessDeny
+		case "trust":
+			rule.Action = AccessTrust
+		default:
+			return nil, fmt.Errorf("access: line %d: unknown action %q", n, fields[0])
+		}
+
+		network, err := parseNetwork(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("access: line %d: %w", n, err)
+		}
+		rule.Network = network
+
+		if len(fields) > 2 {
+			if rule.Action != AccessDeny {
+				return nil, fmt.Errorf("access: line %d: reply given for %s", n, rule.Action)
+			}
+			if !isPermanentCode(fields[2]) {
+				return nil, fmt.Errorf("access: line %d: reply must start with a 5xx code", n)
+			}
+			rule.Reply = strings.Join(fields[2:], " ")
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// parseNetwork parses a network in CIDR notation, or a single address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// isPermanentCode reports whether code is a 5xx reply code.
+func isPermanentCode(code string) bool {
+	return len(code) == 3 && code[0] == '5' &&
+		code[1] >= '0' && code[1] <= '5' &&
+		code[2] >= '0' && code[2] <= '9'
+}
+
+// deny refuses a connection matching rule.
+func (s *Server) deny(conn net.Conn, rule AccessRule) {
+	defer conn.Close()
+
+	s.logger().Info("connection denied",
+		slog.String("remote", conn.RemoteAddr().String()),
+		slog.String("network", rule.Network.String()))
+
+	reply := rule.Reply
+	if reply == "" {
+		reply = rACCESS_DENIED
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "%s\r\n", reply)
+}
@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccessRules(t *testing.T) {
+	rules, err := ParseAccessRules(strings.NewReader(`
+# Local networks
+trust 10.0.0.0/8
+allow 2001:db8::1
+
+deny 192.0.2.0/24 554 5.7.1 Go away
+deny ::/0
+`))
+
+	assert.Nil(t, err)
+	if assert.Len(t, rules, 4) {
+		assert.Equal(t, AccessTrust, rules[0].Action)
+		assert.Equal(t, "10.0.0.0/8", rules[0].Network.String())
+		assert.Equal(t, AccessAllow, rules[1].Action)
+		assert.Equal(t, "2001:db8::1/128", rules[1].Network.String())
+		assert.Equal(t, AccessDeny, rules[2].Action)
+		assert.Equal(t, "554 5.7.1 Go away", rules[2].Reply)
+		assert.Equal(t, "", rules[3].Reply)
+	}
+
+	for _, invalid := range []string{"block 10.0.0.0/8", "deny", "deny 10.0.0.0/33", "allow example.com", "trust 10.0.0.0/8 554 Hi", "deny 10.0.0.0/8 go away", "deny 10.0.0.0/8 421 Bye", "deny 10.0.0.0/8 5541 Hi"} {
+		_, err := ParseAccessRules(strings.NewReader(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestAccessPolicyMatch(t *testing.T) {
+	rules, _ := ParseAccessRules(strings.NewReader(`
+allow 192.0.2.1
+deny 192.0.2.0/24
+trust 2001:db8::/32
+`))
+	policy := NewAccessPolicy(rules)
+
+	assert.Equal(t, AccessAllow, policy.match(net.ParseIP("192.0.2.1")).Action)
+	assert.Equal(t, AccessDeny, policy.match(net.ParseIP("192.0.2.2")).Action)
+	assert.Equal(t, AccessTrust, policy.match(net.ParseIP("2001:db8::2")).Action)
+	assert.Equal(t, AccessRule{}, policy.match(net.ParseIP("198.51.100.1")))
+
+	policy.SetRules(nil)
+	assert.Equal(t, AccessRule{}, policy.match(net.ParseIP("192.0.2.2")))
+
+	var none *AccessPolicy
+	assert.Equal(t, AccessRule{}, none.match(net.ParseIP("192.0.2.2")))
+}
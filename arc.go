@@ -0,0 +1,483 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An ARCStatus is the outcome of validating an ARC chain, using the result
+// names from RFC 8617 section 4.4.
+type ARCStatus string
+
+const (
+	ARCNone ARCStatus = "none"
+	ARCPass ARCStatus = "pass"
+	ARCFail ARCStatus = "fail"
+)
+
+// maxARCInstances is the most ARC sets a message may have.
+const maxARCInstances = 50
+
+// An ARCResult is the result of validating the ARC chain of a message.
+type ARCResult struct {
+	Status ARCStatus
+
+	// Instance is the instance number of the latest ARC set, or zero if the
+	// message has none.
+	Instance int
+
+	// Sealers holds the d= tag of each ARC-Seal, from the first instance to the
+	// latest, if the chain passed.
+	Sealers []string
+
+	// Err explains why the chain did not pass.
+	Err error
+}
+
+// VerifyARC validates the ARC chain, as described in RFC 8617, of the message
+// read from r, looking up keys with resolver. Lines may end with CRLF or LF.
+func VerifyARC(ctx context.Context, resolver TXTResolver, r io.Reader) (ARCResult, error) {
+	br := bufio.NewReader(r)
+
+	fields, err := readFields(br)
+	if err != nil {
+		return ARCResult{}, err
+	}
+
+	v := newARCVerification(fields)
+	if err := canonicalizeBodies(br, v.bodies()); err != nil {
+		return ARCResult{}, err
+	}
+
+	return v.verify(ctx, resolver), nil
+}
+
+// An arcSet is the fields of a single ARC instance.
+type arcSet struct {
+	results   headerField
+	signature headerField
+	seal      headerField
+}
+
+var arcFieldNames = []string{"ARC-Authentication-Results", "ARC-Message-Signature", "ARC-Seal"}
+
+// arcSets returns the ARC sets in fields, ordered by instance, and the highest
+// instance number found. An error is returned if the sets do not form a valid
+// chain.
+func arcSets(fields []headerField) ([]arcSet, int, error) {
+	sets := map[int]*arcSet{}
+	latest := 0
+
+	for _, field := range fields {
+		kind := -1
+		for i, name := range arcFieldNames {
+			if strings.EqualFold(field.name(), name) {
+				kind = i
+			}
+		}
+		if kind < 0 {
+			continue
+		}
+
+		i, err := arcInstance(field)
+		if err != nil {
+			return nil, latest, err
+		}
+		if i > latest {
+			latest = i
+		}
+
+		set, ok := sets[i]
+		if !ok {
+			set = &arcSet{}
+			sets[i] = set
+		}
+
+		slot := [...]*headerField{&set.results, &set.signature, &set.seal}[kind]
+		if *slot != "" {
+			return nil, latest, fmt.Errorf("arc: duplicate %s for instance %d", arcFieldNames[kind], i)
+		}
+		*slot = field
+	}
+
+	chain := make([]arcSet, latest)
+	for i := range chain {
+		set, ok := sets[i+1]
+		if !ok || set.results == "" || set.signature == "" || set.seal == "" {
+			return nil, latest, fmt.Errorf("arc: incomplete set for instance %d", i+1)
+		}
+		chain[i] = *set
+	}
+
+	return chain, latest, nil
+}
+
+// arcInstance returns the value of the i= tag of an ARC field.
+func arcInstance(field headerField) (int, error) {
+	for _, part := range strings.Split(unfold(field.value()), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(name) != "i" {
+			continue
+		}
+
+		i, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || i < 1 || i > maxARCInstances {
+			return 0, fmt.Errorf("arc: invalid instance %q", strings.TrimSpace(value))
+		}
+		return i, nil
+	}
+
+	return 0, fmt.Errorf("arc: %s missing instance", field.name())
+}
+
+func parseARCMessageSignature(value string) (*dkimSignature, error) {
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, fmt.Errorf("arc: %w", err)
+	}
+
+	if err := requireTags(tags, "i", "a", "b", "bh", "d", "h", "s"); err != nil {
+		return nil, fmt.Errorf("arc: %w", err)
+	}
+
+	return parseSignatureTags(tags)
+}
+
+// arcSeal holds the parsed tags of an ARC-Seal field.
+type arcSeal struct {
+	algorithm string
+	signature []byte
+	chain     ARCStatus
+	domain    string
+	selector  string
+}
+
+func parseARCSeal(value string) (*arcSeal, error) {
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, fmt.Errorf("arc: %w", err)
+	}
+
+	if err := requireTags(tags, "i", "a", "b", "cv", "d", "s"); err != nil {
+		return nil, fmt.Errorf("arc: %w", err)
+	}
+	if _, ok := tags["h"]; ok {
+		return nil, errors.New("arc: h= tag in ARC-Seal")
+	}
+
+	seal := &arcSeal{
+		algorithm: strings.ToLower(tags["a"]),
+		chain:     ARCStatus(strings.ToLower(tags["cv"])),
+		domain:    strings.ToLower(tags["d"]),
+		selector:  tags["s"],
+	}
+
+	if seal.algorithm != "rsa-sha256" && seal.algorithm != "ed25519-sha256" {
+		return nil, fmt.Errorf("arc: unsupported algorithm %q", tags["a"])
+	}
+	if seal.chain != ARCNone && seal.chain != ARCPass && seal.chain != ARCFail {
+		return nil, fmt.Errorf("arc: invalid cv= tag %q", tags["cv"])
+	}
+	if seal.signature, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["b"])); err != nil {
+		return nil, errors.New("arc: invalid b= tag")
+	}
+
+	return seal, nil
+}
+
+// arcSealHash computes the hash signed by the ARC-Seal of the last of sets.
+func arcSealHash(sets []arcSet) []byte {
+	h := sha256.New()
+
+	for i, set := range sets {
+		io.WriteString(h, canonicalizeHeader(set.results, true))
+		io.WriteString(h, canonicalizeHeader(set.signature, true))
+
+		if i < len(sets)-1 {
+			io.WriteString(h, canonicalizeHeader(set.seal, true))
+		} else {
+			io.WriteString(h, strings.TrimSuffix(canonicalizeHeader(removeSignature(set.seal), true), "\r\n"))
+		}
+	}
+
+	return h.Sum(nil)
+}
+
+// arcVerification tracks the validation of an ARC chain.
+type arcVerification struct {
+	sets      []arcSet
+	latest    int
+	seals     []*arcSeal
+	signature *dkimVerification
+	err       error
+}
+
+func newARCVerification(fields []headerField) *arcVerification {
+	v := &arcVerification{}
+
+	v.sets, v.latest, v.err = arcSets(fields)
+	if v.err != nil || len(v.sets) == 0 {
+		return v
+	}
+
+	for _, set := range v.sets {
+		seal, err := parseARCSeal(set.seal.value())
+		if err != nil {
+			v.err = err
+			return v
+		}
+		v.seals = append(v.seals, seal)
+	}
+
+	v.signature = newSignatureVerification(fields, v.sets[len(v.sets)-1].signature, parseARCMessageSignature)
+	return v
+}
+
+// bodies returns the body canonicalizers needed to validate the chain.
+func (v *arcVerification) bodies() []*bodyCanonicalizer {
+	if v.signature == nil || v.signature.body == nil {
+		return nil
+	}
+
+	return []*bodyCanonicalizer{v.signature.body}
+}
+
+// failed reports whether the latest ARC-Seal already records a failed chain.
+func (v *arcVerification) failed() bool {
+	return len(v.seals) > 0 && v.seals[len(v.seals)-1].chain == ARCFail
+}
+
+func (v *arcVerification) verify(ctx context.Context, resolver TXTResolver) ARCResult {
+	result := ARCResult{Status: ARCNone, Instance: v.latest}
+
+	fail := func(err error) ARCResult {
+		result.Status, result.Err = ARCFail, err
+		return result
+	}
+
+	if v.err != nil {
+		return fail(v.err)
+	}
+	if len(v.sets) == 0 {
+		return result
+	}
+	if v.failed() {
+		return fail(errors.New("arc: chain has already failed"))
+	}
+
+	for i, seal := range v.seals {
+		expected := ARCPass
+		if i == 0 {
+			expected = ARCNone
+		}
+		if seal.chain != expected {
+			return fail(fmt.Errorf("arc: instance %d has cv=%s", i+1, seal.chain))
+		}
+	}
+
+	if sig := v.signature.verify(ctx, resolver); sig.Status != DKIMPass {
+		return fail(fmt.Errorf("arc: message signature %d: %w", len(v.sets), sig.Err))
+	}
+
+	for i := len(v.seals) - 1; i >= 0; i-- {
+		seal := v.seals[i]
+
+		key, err := lookupDKIMKey(ctx, resolver, seal.selector, seal.domain)
+		if err != nil {
+			return fail(fmt.Errorf("arc: seal %d: %w", i+1, err))
+		}
+		if err := key.verify(seal.algorithm, arcSealHash(v.sets[:i+1]), seal.signature); err != nil {
+			return fail(fmt.Errorf("arc: seal %d: %w", i+1, err))
+		}
+	}
+
+	result.Status = ARCPass
+	for _, seal := range v.seals {
+		result.Sealers = append(result.Sealers, seal.domain)
+	}
+
+	return result
+}
+
+// An ARCSealer adds ARC sets, as described in RFC 8617, to messages that are
+// passed on, such as by a forwarder, so that later receivers can trust the
+// authentication results found when they were received.
+type ARCSealer struct {
+	// Domain is the domain the sets are signed for. The key for it is found in
+	// Keys.
+	Domain string
+	Keys   KeyStore
+
+	// AuthServID identifies the Authentication-Results field whose results are
+	// copied into the ARC-Authentication-Results field. This is normally the
+	// name of the Server that received the message, which removes any others
+	// claiming it, but if there are several the top-most is used.
+	AuthServID string
+
+	// Headers lists the fields to sign in the ARC-Message-Signature, any not in
+	// the message are skipped. If nil a default list is used.
+	Headers []string
+
+	// Resolver is used to validate the existing chain. If nil
+	// net.DefaultResolver is used.
+	Resolver TXTResolver
+}
+
+// Seal validates the ARC chain of the message read from r and returns the
+// fields of a new ARC set to prepend to it, using the same line endings as the
+// message.
+func (a *ARCSealer) Seal(ctx context.Context, r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	eol := lineEnding(br)
+
+	fields, err := readFields(br)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := a.Keys.SigningKey(ctx, a.Domain)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := key.algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	v := newARCVerification(fields)
+	if v.failed() {
+		return nil, errors.New("arc: chain has already failed")
+	}
+
+	instance := v.latest + 1
+	if instance > maxARCInstances {
+		return nil, errors.New("arc: too many instances")
+	}
+
+	body := newBodyCanonicalizer(true, -1)
+	if err := canonicalizeBodies(br, append(v.bodies(), body)); err != nil {
+		return nil, err
+	}
+
+	chain := v.verify(ctx, a.resolver())
+	cv := chain.Status
+	if instance == 1 {
+		cv = ARCNone
+	}
+
+	i := "i=" + strconv.Itoa(instance)
+	t := "t=" + strconv.FormatInt(time.Now().Unix(), 10)
+
+	results := headerField("ARC-Authentication-Results: " + i + "; " + a.AuthServID + ";\r\n\t" +
+		strings.Join(a.results(fields, chain), ";\r\n\t") + "\r\n")
+
+	names := presentFields(fields, a.headers())
+	signature, err := signField(key, "ARC-Message-Signature", []string{
+		i, "a=" + algorithm, "c=relaxed/relaxed", "d=" + a.Domain, "s=" + key.Selector, t,
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(body.sum()),
+	}, func(field headerField) []byte {
+		return headerHash(fields, names, field, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sets := append(v.sets, arcSet{results: results, signature: signature})
+	seal, err := signField(key, "ARC-Seal", []string{
+		i, "a=" + algorithm, t, "cv=" + string(cv), "d=" + a.Domain, "s=" + key.Selector,
+	}, func(field headerField) []byte {
+		sets[len(sets)-1].seal = field
+		return arcSealHash(sets)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	set := string(seal) + string(signature) + string(results)
+	return []byte(strings.ReplaceAll(set, "\r\n", eol)), nil
+}
+
+// SealMessage returns msg with a new ARC set prepended to its Data.
+func (a *ARCSealer) SealMessage(ctx context.Context, msg Message) (Message, error) {
+	set, err := a.Seal(ctx, bytes.NewReader(msg.Data))
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Data = append(set, msg.Data...)
+	return msg, nil
+}
+
+func (a *ARCSealer) resolver() TXTResolver {
+	if a.Resolver != nil {
+		return a.Resolver
+	}
+
+	return net.DefaultResolver
+}
+
+func (a *ARCSealer) headers() []string {
+	if a.Headers != nil {
+		return a.Headers
+	}
+
+	return defaultSignedHeaders
+}
+
+// results returns the results from the top-most Authentication-Results field
+// added by AuthServID, along with the result of validating the chain if they do
+// not include it. Only that field is used, as any below it were in the message
+// before it was received and so may be forged.
+func (a *ARCSealer) results(fields []headerField, chain ARCResult) []string {
+	var results []string
+	hasARC := false
+
+	for _, field := range fields {
+		if !strings.EqualFold(field.name(), "Authentication-Results") ||
+			!strings.EqualFold(authServID(field.value()), a.AuthServID) {
+			continue
+		}
+
+		_, rest, _ := strings.Cut(unfold(field.value()), ";")
+		for _, result := range strings.Split(rest, ";") {
+			result = strings.TrimSpace(compressWhitespace(result))
+			if result == "" || result == "none" {
+				continue
+			}
+			if strings.HasPrefix(result, "arc=") {
+				hasARC = true
+			}
+			results = append(results, result)
+		}
+		break
+	}
+
+	if !hasARC {
+		results = append(results, "arc="+string(chain.Status))
+	}
+
+	return results
+}
+
+// lineEnding returns the line ending used by the first line read from r,
+// without consuming it.
+func lineEnding(r *bufio.Reader) string {
+	p, _ := r.Peek(r.Size())
+
+	if i := bytes.IndexByte(p, '\n'); i >= 0 && (i == 0 || p[i-1] != '\r') {
+		return "\n"
+	}
+
+	return "\r\n"
+}
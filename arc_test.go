@@ -0,0 +1,193 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const arcMessage = `Authentication-Results: mx.forwarder.example;
+	spf=pass smtp.mailfrom=joe@football.example.com;
+	dkim=pass header.d=football.example.com
+Authentication-Results: mx.other.example; spf=fail
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@forwarder.example>
+Subject: Is dinner ready?
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+
+func newARCSealers(t *testing.T) (*ARCSealer, *ARCSealer, TestResolver) {
+	edKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+
+	resolver := TestResolver{TXT: map[string][]string{
+		"arc._domainkey.forwarder.example": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))},
+		"seal._domainkey.list.example":     {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+	}}
+
+	first := &ARCSealer{
+		Domain:     "forwarder.example",
+		Keys:       KeyMap{"forwarder.example": {Selector: "arc", Key: edKey}},
+		AuthServID: "mx.forwarder.example",
+		Resolver:   resolver,
+	}
+
+	second := &ARCSealer{
+		Domain:     "list.example",
+		Keys:       KeyMap{"list.example": {Selector: "seal", Key: rsaKey}},
+		AuthServID: "mx.list.example",
+		Resolver:   resolver,
+	}
+
+	return first, second, resolver
+}
+
+func seal(t *testing.T, sealer *ARCSealer, msg string) string {
+	set, err := sealer.Seal(context.Background(), strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(set) + msg
+}
+
+func TestARCSeal(t *testing.T) {
+	first, _, resolver := newARCSealers(t)
+
+	set, err := first.Seal(context.Background(), strings.NewReader(arcMessage))
+	assert.Nil(t, err)
+
+	assert.Regexp(t, regexp.MustCompile(`^ARC-Seal: i=1; a=ed25519-sha256; t=\d+; cv=none; d=forwarder.example;\n`+
+		`\ts=arc;\n`+
+		`\tb=[A-Za-z0-9+/]+\n\t [A-Za-z0-9+/=]+\n`+
+		`ARC-Message-Signature: i=1; a=ed25519-sha256; c=relaxed/relaxed;\n`+
+		`\td=forwarder.example; s=arc; t=\d+; h=From:Subject:To;\n`+
+		`\tbh=[A-Za-z0-9+/=]+;\n`+
+		`\tb=[A-Za-z0-9+/]+\n\t [A-Za-z0-9+/=]+\n`+
+		`ARC-Authentication-Results: i=1; mx.forwarder.example;\n`+
+		`\tspf=pass smtp.mailfrom=joe@football.example.com;\n`+
+		`\tdkim=pass header.d=football.example.com;\n`+
+		`\tarc=none\n$`), string(set))
+
+	result, err := VerifyARC(context.Background(), resolver, strings.NewReader(string(set)+arcMessage))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCResult{Status: ARCPass, Instance: 1, Sealers: []string{"forwarder.example"}}, result)
+}
+
+func TestARCSealWithForgedResults(t *testing.T) {
+	first, _, _ := newARCSealers(t)
+
+	msg := "Authentication-Results: mx.forwarder.example; spf=fail smtp.mailfrom=joe@football.example.com\n" +
+		"Authentication-Results: mx.forwarder.example; dmarc=pass header.from=bank.example\n" +
+		strings.TrimPrefix(arcMessage, "Authentication-Results: mx.forwarder.example;\n\tspf=pass smtp.mailfrom=joe@football.example.com;\n\tdkim=pass header.d=football.example.com\n")
+
+	set, err := first.Seal(context.Background(), strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(string(set), "ARC-Authentication-Results: i=1; mx.forwarder.example;\n"+
+		"\tspf=fail smtp.mailfrom=joe@football.example.com;\n"+
+		"\tarc=none\n"), string(set))
+}
+
+func TestARCSealWithChain(t *testing.T) {
+	first, second, resolver := newARCSealers(t)
+
+	msg := seal(t, second, seal(t, first, arcMessage))
+	assert.Contains(t, msg, "cv=pass")
+
+	result, err := VerifyARC(context.Background(), resolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCResult{Status: ARCPass, Instance: 2, Sealers: []string{"forwarder.example", "list.example"}}, result)
+
+	result, err = VerifyARC(context.Background(), resolver, strings.NewReader(strings.ReplaceAll(msg, "\n", "\r\n")))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCPass, result.Status)
+}
+
+func TestARCSealMessage(t *testing.T) {
+	first, _, resolver := newARCSealers(t)
+
+	msg, err := first.SealMessage(context.Background(), Message{ID: "1", Data: []byte(arcMessage)})
+	assert.Nil(t, err)
+	assert.Equal(t, "1", msg.ID)
+	assert.True(t, strings.HasPrefix(string(msg.Data), "ARC-Seal: i=1;"))
+
+	result, err := VerifyARC(context.Background(), resolver, strings.NewReader(string(msg.Data)))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCPass, result.Status)
+}
+
+func TestVerifyARCWithoutChain(t *testing.T) {
+	result, err := VerifyARC(context.Background(), TestResolver{}, strings.NewReader(arcMessage))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCResult{Status: ARCNone}, result)
+}
+
+func TestVerifyARCWithModifiedBody(t *testing.T) {
+	first, second, resolver := newARCSealers(t)
+
+	msg := seal(t, second, seal(t, first, arcMessage))
+	msg = strings.Replace(msg, "We lost", "We won", 1)
+
+	result, err := VerifyARC(context.Background(), resolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCFail, result.Status)
+	assert.Equal(t, 2, result.Instance)
+}
+
+func TestVerifyARCWithModifiedResults(t *testing.T) {
+	first, second, resolver := newARCSealers(t)
+
+	msg := seal(t, second, seal(t, first, arcMessage))
+	msg = strings.Replace(msg, "\tdkim=pass header.d=football.example.com;\n\tarc=none", "\tdkim=pass header.d=football.example.com;\n\tarc=pass", 1)
+
+	result, err := VerifyARC(context.Background(), resolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCFail, result.Status)
+}
+
+func TestVerifyARCWithMissingSet(t *testing.T) {
+	first, second, resolver := newARCSealers(t)
+
+	msg := seal(t, second, seal(t, first, arcMessage))
+	start := strings.Index(msg, "ARC-Seal: i=1;")
+	end := strings.Index(msg, "ARC-Message-Signature: i=1;")
+	msg = msg[:start] + msg[end:]
+
+	result, err := VerifyARC(context.Background(), resolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCFail, result.Status)
+	assert.Equal(t, 2, result.Instance)
+}
+
+func TestARCSealWithFailedChain(t *testing.T) {
+	first, second, resolver := newARCSealers(t)
+
+	msg := strings.Replace(seal(t, first, arcMessage), "We lost", "We won", 1)
+	msg = seal(t, second, msg)
+	assert.Contains(t, msg, "cv=fail")
+
+	result, err := VerifyARC(context.Background(), resolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, ARCFail, result.Status)
+
+	_, err = first.Seal(context.Background(), strings.NewReader(msg))
+	assert.NotNil(t, err)
+}
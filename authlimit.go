@@ -0,0 +1,270 @@
+package smtp
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuthMaxFailures = 5
+	defaultAuthLockout     = time.Minute
+	defaultAuthMaxLockout  = 24 * time.Hour
+)
+
+// An AuthLimiter protects AUTH against guessing by locking out client
+// addresses and usernames that fail to authenticate too many times. Each
+// lockout of the same address or username lasts twice as long as the last.
+type AuthLimiter struct {
+	// MaxFailures is the number of failed attempts after which an address or
+	// username is locked out. If zero it is 5.
+	MaxFailures int
+
+	// Lockout is how long the first lockout lasts. If zero it is 1 minute.
+	Lockout time.Duration
+
+	// MaxLockout is the longest a lockout lasts. Failures and lockouts are
+	// forgotten once there have been none for this long. If zero it is 24
+	// hours.
+	MaxLockout time.Duration
+
+	// OnEvent, if set, is called for each attempt to authenticate, for example
+	// to report failures to a firewall.
+	OnEvent func(AuthEvent)
+
+	mu      sync.Mutex
+	records map[string]*authRecord
+	pruned  time.Time
+}
+
+// AuthEventType is the outcome of an attempt to authenticate.
+type AuthEventType int
+
+const (
+	// AuthSucceeded is an attempt with valid credentials.
+	AuthSucceeded AuthEventType = iota
+
+	// AuthFailed is an attempt with invalid credentials.
+	AuthFailed
+
+	// AuthLockedOut is a failed attempt that caused the client address or
+	// username to be locked out.
+	AuthLockedOut
+
+	// AuthRefused is an attempt from an address, or for a username, that is
+	// locked out. The credentials are not checked.
+	AuthRefused
+)
+
+func (t AuthEventType) String() string {
+	switch t {
+	case AuthSucceeded:
+		return "succeeded"
+	case AuthFailed:
+		return "failed"
+	case AuthLockedOut:
+		return "locked out"
+	case AuthRefused:
+		return "refused"
+	}
+
+	return "unknown"
+}
+
+// An AuthEvent describes an attempt to authenticate.
+type AuthEvent struct {
+	Type       AuthEventType
+	Time       time.Time
+	SessionID  string
+	RemoteAddr net.Addr
+
+	// User is the username given, or empty if the attempt was refused before
+	// one was.
+	User string
+
+	// Until is when the lockout ends, for AuthLockedOut and AuthRefused events.
+	Until time.Time
+}
+
+type authRecord struct {
+	failures int
+	lockouts int
+	last     time.Time
+	until    time.Time
+}
+
+// lockedOut returns when the lockout of the client at ip, or of user if not
+// empty, ends, or false if neither is locked out.
+func (l *AuthLimiter) lockedOut(ip net.IP, user string, now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var until time.Time
+	for _, key := range authKeys(ip, user) {
+		if record, ok := l.records[key]; ok && record.until.After(now) && record.until.After(until) {
+			until = record.until
+		}
+	}
+
+	return until, !until.IsZero()
+}
+
+// failed records a failed attempt to authenticate as user from the client at
+// ip, returning when the lockout ends if it caused one.
+func (l *AuthLimiter) failed(ip net.IP, user string, now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	var until time.Time
+	for _, key := range authKeys(ip, user) {
+		record, ok := l.records[key]
+		if !ok {
+			record = &authRecord{}
+			l.records[key] = record
+		}
+
+		record.failures++
+		record.last = now
+
+		if record.failures < l.maxFailures() {
+			continue
+		}
+
+		record.failures = 0
+		record.lockouts++
+		record.until = now.Add(l.lockout(record.lockouts))
+
+		if record.until.After(until) {
+			until = record.until
+		}
+	}
+
+	return until, !until.IsZero()
+}
+
+// succeeded forgets the failed attempts to authenticate as user.
+func (l *AuthLimiter) succeeded(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.records, "user:"+strings.ToLower(user))
+}
+
+// prune forgets records that have not failed for MaxLockout, at most once a
+// minute.
+func (l *AuthLimiter) prune(now time.Time) {
+	if l.records == nil {
+		l.records = map[string]*authRecord{}
+	}
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+
+	for key, record := range l.records {
+		if now.Sub(record.last) > l.maxLockout() && !record.until.After(now) {
+			delete(l.records, key)
+		}
+	}
+	l.pruned = now
+}
+
+// lockout returns how long the nth lockout lasts.
+func (l *AuthLimiter) lockout(n int) time.Duration {
+	d := l.Lockout
+	if d == 0 {
+		d = defaultAuthLockout
+	}
+
+	for i := 1; i < n && d < l.maxLockout(); i++ {
+		d *= 2
+	}
+	if d > l.maxLockout() {
+		return l.maxLockout()
+	}
+
+	return d
+}
+
+func (l *AuthLimiter) maxFailures() int {
+	if l.MaxFailures == 0 {
+		return defaultAuthMaxFailures
+	}
+
+	return l.MaxFailures
+}
+
+func (l *AuthLimiter) maxLockout() time.Duration {
+	if l.MaxLockout == 0 {
+		return defaultAuthMaxLockout
+	}
+
+	return l.MaxLockout
+}
+
+func authKeys(ip net.IP, user string) []string {
+	var keys []string
+	if ip != nil {
+		keys = append(keys, "ip:"+ip.String())
+	}
+	if user != "" {
+		keys = append(keys, "user:"+strings.ToLower(user))
+	}
+
+	return keys
+}
+
+// authLockedOut reports whether the client, or user if not empty, is locked
+// out of AUTH, recording the refused attempt if so.
+func (s *Server) authLockedOut(sess *session, user string) bool {
+	if s.AuthLimiter == nil {
+		return false
+	}
+
+	until, locked := s.AuthLimiter.lockedOut(sess.remoteIP(), user, time.Now())
+	if locked {
+		sess.logger.Warn("authentication locked out", slog.String("user", user), slog.Time("until", until))
+		s.authEvent(sess, AuthRefused, user, until)
+	}
+
+	return locked
+}
+
+// authResult records the outcome of checking the credentials given for user.
+func (s *Server) authResult(sess *session, user string, ok bool) {
+	if s.AuthLimiter == nil {
+		return
+	}
+
+	if ok {
+		s.AuthLimiter.succeeded(user)
+		s.authEvent(sess, AuthSucceeded, user, time.Time{})
+		return
+	}
+
+	if until, locked := s.AuthLimiter.failed(sess.remoteIP(), user, time.Now()); locked {
+		sess.logger.Warn("authentication locked out", slog.String("user", user), slog.Time("until", until))
+		s.authEvent(sess, AuthLockedOut, user, until)
+		return
+	}
+
+	s.authEvent(sess, AuthFailed, user, time.Time{})
+}
+
+func (s *Server) authEvent(sess *session, typ AuthEventType, user string, until time.Time) {
+	if s.AuthLimiter.OnEvent == nil {
+		return
+	}
+
+	s.AuthLimiter.OnEvent(AuthEvent{
+		Type:       typ,
+		Time:       time.Now(),
+		SessionID:  sess.id,
+		RemoteAddr: sess.remoteAddr,
+		User:       user,
+		Until:      until,
+	})
+}
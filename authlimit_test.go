@@ -0,0 +1,66 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthLimiter(t *testing.T) {
+	var (
+		l     = &AuthLimiter{MaxFailures: 2, Lockout: time.Minute, MaxLockout: 3 * time.Minute}
+		ip    = net.ParseIP("192.0.2.1")
+		other = net.ParseIP("192.0.2.2")
+		now   = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	_, locked := l.failed(ip, "john", now)
+	assert.False(t, locked)
+
+	until, locked := l.failed(ip, "john", now)
+	assert.True(t, locked)
+	assert.Equal(t, now.Add(time.Minute), until)
+
+	_, locked = l.lockedOut(ip, "", now)
+	assert.True(t, locked)
+	_, locked = l.lockedOut(other, "JOHN", now)
+	assert.True(t, locked)
+	_, locked = l.lockedOut(other, "jane", now)
+	assert.False(t, locked)
+
+	now = now.Add(time.Minute)
+	_, locked = l.lockedOut(ip, "john", now)
+	assert.False(t, locked)
+
+	l.failed(other, "john", now)
+	until, _ = l.failed(other, "john", now)
+	assert.Equal(t, now.Add(2*time.Minute), until, "john locked out for the second time")
+
+	_, locked = l.lockedOut(ip, "", now)
+	assert.False(t, locked)
+
+	now = now.Add(2 * time.Minute)
+	l.failed(other, "john", now)
+	until, _ = l.failed(other, "john", now)
+	assert.Equal(t, now.Add(3*time.Minute), until, "capped at MaxLockout")
+
+	l.succeeded("john")
+	_, locked = l.lockedOut(nil, "john", now)
+	assert.False(t, locked)
+}
+
+func TestAuthLimiterForgets(t *testing.T) {
+	var (
+		l   = &AuthLimiter{MaxFailures: 2, MaxLockout: time.Hour}
+		ip  = net.ParseIP("192.0.2.1")
+		now = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	l.failed(ip, "john", now)
+	l.failed(ip, "jane", now.Add(2*time.Hour))
+
+	_, locked := l.lockedOut(ip, "", now.Add(2*time.Hour))
+	assert.False(t, locked)
+}
@@ -0,0 +1,122 @@
+package smtp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// A Blocklist is a DNS blocklist, as described in RFC 5782.
+type Blocklist struct {
+	// Zone is the domain the list is published under, such as
+	// zen.spamhaus.org.
+	Zone string
+
+	// Domains, if true, makes the list a RHSBL: the domain of the sender given
+	// in MAIL is looked up, rather than the client's IP.
+	Domains bool
+
+	// Reject, if true, refuses clients that are listed. Otherwise the listing
+	// only adds Score to the Session.
+	Reject bool
+
+	// Score is added to the Session's score for a listing.
+	Score int
+}
+
+// A Listing records that a client or sender domain was found on a Blocklist.
+type Listing struct {
+	Blocklist
+
+	// Name is the IP or domain that is listed.
+	Name string
+
+	// Codes are the addresses returned for the listing, which some lists use
+	// to give the reason.
+	Codes []string
+}
+
+// blocklistQuery returns the name to look up for ip in zone, with the octets,
+// or for IPv6 the nibbles, reversed.
+func blocklistQuery(ip net.IP, zone string) string {
+	labels := strings.Split(macroIP(ip), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return strings.Join(labels, ".") + "." + strings.TrimSuffix(zone, ".") + "."
+}
+
+// checkBlocklists looks up name, or for lists of IPs ip, in each of the
+// blocklists of the given kind. Lookups are made concurrently, and any errors
+// are logged and treated as the name not being listed.
+func (s *Server) checkBlocklists(sess *session, domains bool, ip net.IP, name string) []Listing {
+	ctx, cancel := context.WithTimeout(sess.ctx, lookupTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	found := make([]*Listing, len(s.Blocklists))
+
+	for i, list := range s.Blocklists {
+		if list.Domains != domains {
+			continue
+		}
+
+		query := strings.TrimSuffix(name, ".") + "." + strings.TrimSuffix(list.Zone, ".") + "."
+		if !domains {
+			query = blocklistQuery(ip, list.Zone)
+		}
+
+		wg.Add(1)
+		go func(i int, list Blocklist, query string) {
+			defer wg.Done()
+
+			codes, err := lookupBlocklist(ctx, s.resolver(), query)
+			if err != nil {
+				sess.logger.Warn("blocklist", slog.String("zone", list.Zone), slog.Any("err", err))
+				return
+			}
+			if len(codes) > 0 {
+				found[i] = &Listing{Blocklist: list, Name: name, Codes: codes}
+			}
+		}(i, list, query)
+	}
+
+	wg.Wait()
+
+	var listings []Listing
+	for _, listing := range found {
+		if listing != nil {
+			sess.logger.Info("blocklisted", slog.String("zone", listing.Zone), slog.String("name", listing.Name), slog.Any("codes", listing.Codes))
+			listings = append(listings, *listing)
+		}
+	}
+
+	return listings
+}
+
+// lookupBlocklist returns the addresses query resolves to in 127.0.0.0/8, the
+// range that indicates a listing. Lists that refuse a query answer in
+// 127.255.255.0/24, so those are ignored.
+func lookupBlocklist(ctx context.Context, resolver Resolver, query string) ([]string, error) {
+	addrs, err := resolver.LookupIPAddr(ctx, query)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var codes []string
+	for _, addr := range addrs {
+		ip := addr.IP.To4()
+		if ip == nil || ip[0] != 127 || (ip[1] == 255 && ip[2] == 255) {
+			continue
+		}
+		codes = append(codes, ip.String())
+	}
+
+	return codes, nil
+}
@@ -0,0 +1,14 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocklistQuery(t *testing.T) {
+	assert.Equal(t, "2.0.0.127.zen.example.", blocklistQuery(net.ParseIP("127.0.0.2"), "zen.example"))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example.",
+		blocklistQuery(net.ParseIP("2001:db8::1"), "zen.example."))
+}
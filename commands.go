@@ -1,8 +1,12 @@
 package smtp
 
 import (
+	"bytes"
+	"io"
+	"log/slog"
 	"regexp"
-	"log"
+	"strings"
+	"time"
 )
 
 var (
@@ -10,7 +14,9 @@ var (
 	rcptRe = regexp.MustCompile("TO:<(.+)>")
 )
 
-func mail(args string, text connection, tran transaction) transaction {
+// mail handles a MAIL command. The sender is passed to check, which returns a
+// reply to reject it with or an empty string to accept it.
+func mail(args string, text connection, tran transaction, check func(string) string) transaction {
 	matches := mailRe.FindStringSubmatch(args)
 	if matches == nil || len(matches) != 2 {
 		text.write(rSYNTAX_ERROR)
@@ -18,6 +24,11 @@ func mail(args string, text connection, tran transaction) transaction {
 	}
 
 	if newTransaction, ok := tran.Sender(matches[1]); ok {
+		if reply := check(matches[1]); reply != "" {
+			text.write("%s", reply)
+			return tran
+		}
+
 		text.write(rOK)
 		return newTransaction
 	}
@@ -26,14 +37,110 @@ func mail(args string, text connection, tran transaction) transaction {
 	return tran
 }
 
-func rcpt(args string, text connection, tran transaction) transaction {
+// validAddress reports whether addr is a mailbox as described in RFC 5321
+// section 4.1.2: a dot-atom or quoted-string local part, and a domain or
+// address literal.
+func validAddress(addr string) bool {
+	i := strings.LastIndexByte(addr, '@')
+	if i <= 0 {
+		return false
+	}
+	local, domain := addr[:i], addr[i+1:]
+
+	if strings.HasPrefix(domain, "[") {
+		if heloIP(domain) == nil {
+			return false
+		}
+	} else if !validAddressDomain(domain) {
+		return false
+	}
+
+	if strings.HasPrefix(local, `"`) {
+		return validQuotedString(local)
+	}
+
+	return isDotAtom(local)
+}
+
+// isDotAtom reports whether s is atoms separated by single dots.
+func isDotAtom(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" || strings.IndexFunc(atom, func(r rune) bool { return !isAtext(r) }) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validAddressDomain reports whether domain is made of labels of letters,
+// digits and hyphens.
+func validAddressDomain(domain string) bool {
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validQuotedString reports whether s is a quoted-string of printable ASCII.
+func validQuotedString(s string) bool {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return false
+	}
+
+	for i := 1; i < len(s)-1; i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+			if i == len(s)-1 || s[i] < ' ' || s[i] > '~' {
+				return false
+			}
+		case c == '"', c < ' ', c > '~':
+			return false
+		}
+	}
+	return true
+}
+
+// isAtext reports whether r may appear in an atom, see RFC 5322 section 3.2.3.
+func isAtext(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' ||
+		strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+// rcpt handles a RCPT command. The recipient must be a valid address, or the
+// bare "postmaster", and is passed to check, which returns a reply to reject it
+// with or an empty string to accept it.
+func rcpt(args string, text connection, tran transaction, check func(string) string) transaction {
 	matches := rcptRe.FindStringSubmatch(args)
 	if matches == nil || len(matches) != 2 {
 		text.write(rSYNTAX_ERROR)
 		return tran
 	}
 
+	if !validAddress(matches[1]) && !strings.EqualFold(matches[1], "postmaster") {
+		text.write(rSYNTAX_ERROR)
+		return tran
+	}
+
 	if newTransaction, ok := tran.Recipient(matches[1]); ok {
+		if reply := check(matches[1]); reply != "" {
+			text.write("%s", reply)
+			return tran
+		}
+
 		text.write(rOK)
 		return newTransaction
 	} else {
@@ -42,7 +149,41 @@ func rcpt(args string, text connection, tran transaction) transaction {
 	}
 }
 
-func data(text connection, tran transaction) (Message, bool) {
+// receive runs the checks on a buffered message, then queues it to be passed to
+// the Handlers.
+func (s *Server) receive(sess *session, text connection, message Message) {
+	size := int64(len(message.Data))
+	message.ID = s.newQueueID()
+	message.ctx = sess.ctx
+
+	whole := func() (io.Reader, error) {
+		return bytes.NewReader(message.Data), nil
+	}
+	if reply := s.checkContent(sess, &message, message.Data, whole); reply != "" {
+		s.Metrics.message(false, size)
+		text.write("%s", reply)
+		return
+	}
+
+	if s.addsAuthenticationResults() {
+		message.Data = removeAuthenticationResults(message.Data, s.name)
+	}
+
+	if headers := s.traceHeaders(sess, message, time.Now(), s.eol()); len(headers) > 0 {
+		message.Data = append(headers, message.Data...)
+	}
+
+	accepted := s.dispatch(message)
+	s.Metrics.message(accepted, size)
+
+	if accepted {
+		text.write(rQUEUED, message.ID)
+	} else {
+		text.write(rBUSY)
+	}
+}
+
+func data(text connection, tran transaction, raw bool) (Message, bool) {
 	if _, ok := tran.Data([]byte{}); !ok {
 		text.write(rOUT_OF_SEQUENCE)
 		return Message{}, false
@@ -50,13 +191,127 @@ func data(text connection, tran transaction) (Message, bool) {
 
 	text.write(rEND_DATA_WITH)
 
-	data, err := text.readAll()
+	data, err := text.readAll(raw)
 	if err != nil {
-		log.Println("DATA:", err)
+		text.session.logger.Error("DATA", slog.Any("err", err))
 		return Message{}, false
 	}
 
-	text.write(rOK)
 	message, _ := tran.Data(data)
 	return message, true
 }
+
+// dataStream reads the message body, passing it to the StreamHandler as it is
+// read. It returns the number of bytes read, whether the handler accepted the
+// message and whether the transaction was completed.
+func (s *Server) dataStream(sess *session, text connection, tran transaction) (n int64, accepted, ok bool) {
+	message, ok := tran.Data(nil)
+	if !ok {
+		text.write(rOUT_OF_SEQUENCE)
+		return 0, false, false
+	}
+	message.ID = s.newQueueID()
+
+	text.write(rEND_DATA_WITH)
+
+	dot := &countingReader{r: text.dotReader(s.RawData)}
+
+	// The handler may not consume the whole body, but the rest of it must be
+	// read before the next command can be.
+	drain := func() bool {
+		if _, err := io.Copy(io.Discard, dot); err != nil {
+			sess.logger.Error("DATA", slog.Any("err", err))
+			return false
+		}
+		return true
+	}
+
+	header, body, err := readHeader(dot)
+	if err != nil {
+		sess.logger.Error("DATA", slog.Any("err", err))
+		return dot.n, false, false
+	}
+
+	// The whole body is only available to content checks if it is spooled.
+	var whole func() (io.Reader, error)
+
+	if s.SpoolThreshold > 0 {
+		sp := newSpool(s.SpoolThreshold, s.SpoolDir)
+		defer sp.Close()
+
+		if _, err := io.Copy(sp, body); err != nil {
+			sess.logger.Error("DATA", slog.Any("err", err))
+			if !drain() {
+				return dot.n, false, false
+			}
+			text.write(rLOCAL_ERROR)
+			return dot.n, false, true
+		}
+
+		r, err := sp.Reader()
+		if err != nil {
+			sess.logger.Error("DATA", slog.Any("err", err))
+			text.write(rLOCAL_ERROR)
+			return dot.n, false, true
+		}
+		body, whole = r, sp.Reader
+	}
+
+	if reply := s.checkContent(sess, &message, header, whole); reply != "" {
+		if !drain() {
+			return dot.n, false, false
+		}
+		text.write("%s", reply)
+		return dot.n, false, true
+	}
+
+	if whole != nil {
+		if body, err = whole(); err != nil {
+			sess.logger.Error("DATA", slog.Any("err", err))
+			text.write(rLOCAL_ERROR)
+			return dot.n, false, true
+		}
+	}
+
+	// The body starts with the header, which is replaced if any fields are
+	// removed from it.
+	if s.addsAuthenticationResults() {
+		if stripped := removeAuthenticationResults(header, s.name); len(stripped) != len(header) {
+			if _, err := io.CopyN(io.Discard, body, int64(len(header))); err != nil {
+				sess.logger.Error("DATA", slog.Any("err", err))
+				if !drain() {
+					return dot.n, false, false
+				}
+				text.write(rLOCAL_ERROR)
+				return dot.n, false, true
+			}
+			body = io.MultiReader(bytes.NewReader(stripped), body)
+		}
+	}
+
+	err = s.streamHandler(sess)(message, body)
+
+	if !drain() {
+		return dot.n, false, false
+	}
+
+	if err != nil {
+		sess.logger.Error("DATA", slog.Any("err", err))
+		text.write(rLOCAL_ERROR)
+		return dot.n, false, true
+	}
+
+	text.write(rQUEUED, message.ID)
+	return dot.n, true, true
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,17 +1,41 @@
 package smtp
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/textproto"
 	"strings"
+	"time"
 )
 
-func newConn(conn net.Conn) connection {
-	return connection{textproto.NewConn(conn)}
+func newConn(conn net.Conn, sess *session) connection {
+	return connection{textproto.NewConn(conn), conn, sess}
 }
 
 type connection struct {
 	*textproto.Conn
+	conn    net.Conn
+	session *session
+}
+
+// inputWithin waits up to d for the client to send something, reporting
+// whether it did. Nothing is consumed.
+func (conn connection) inputWithin(d time.Duration) bool {
+	conn.conn.SetReadDeadline(time.Now().Add(d))
+	defer conn.conn.SetReadDeadline(time.Time{})
+
+	_, err := conn.R.Peek(1)
+	return err == nil
+}
+
+// pending reports whether the client has sent input that has not yet been
+// read.
+func (conn connection) pending() bool {
+	return conn.R.Buffered() > 0
 }
 
 func (conn connection) read() (string, string, error) {
@@ -20,6 +44,34 @@ func (conn connection) read() (string, string, error) {
 		return "", "", err
 	}
 
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+
+	logged, args := line, parts[1]
+	if conn.session.redactAuth && strings.EqualFold(parts[0], "AUTH") && args != "" {
+		logged, args = parts[0]+" [redacted]", "[redacted]"
+	}
+	conn.session.logger.Debug("command", slog.String("line", logged))
+	conn.session.command(strings.ToUpper(parts[0]), args)
+
+	return parts[0], parts[1], nil
+}
+
+// readAuth reads a line sent in response to an AUTH challenge.
+func (conn connection) readAuth() (string, string, error) {
+	line, err := conn.ReadLine()
+	if err != nil {
+		return "", "", err
+	}
+
+	logged := line
+	if conn.session.redactAuth {
+		logged = "[redacted]"
+	}
+	conn.session.logger.Debug("command", slog.String("line", logged))
+
 	parts := strings.SplitN(line, " ", 2)
 	if len(parts) == 1 {
 		return parts[0], "", nil
@@ -28,7 +80,18 @@ func (conn connection) read() (string, string, error) {
 	return parts[0], parts[1], nil
 }
 
-func (conn connection) readAll() ([]byte, error) {
+// readAll reads a dot-encoded block. If raw is true the original line endings
+// are kept, otherwise they are normalised to LF.
+func (conn connection) readAll(raw bool) ([]byte, error) {
+	if raw {
+		d, err := io.ReadAll(conn.dotReader(true))
+		if err != nil {
+			return []byte{}, err
+		}
+
+		return d, nil
+	}
+
 	d, err := conn.ReadDotBytes()
 	if err != nil {
 		return []byte{}, err
@@ -37,6 +100,62 @@ func (conn connection) readAll() ([]byte, error) {
 	return d, nil
 }
 
+// dotReader returns a reader for a dot-encoded block, see readAll.
+func (conn connection) dotReader(raw bool) io.Reader {
+	if raw {
+		return &rawDotReader{r: conn.R}
+	}
+
+	return conn.DotReader()
+}
+
+// rawDotReader reads a dot-encoded block removing dot-stuffing and the final
+// terminating line, but otherwise returning the bytes as they were sent.
+type rawDotReader struct {
+	r    *bufio.Reader
+	line []byte
+	done bool
+}
+
+func (d *rawDotReader) Read(p []byte) (int, error) {
+	for len(d.line) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+
+		line, err := d.r.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		if bytes.Equal(line, []byte(".\r\n")) || bytes.Equal(line, []byte(".\n")) {
+			d.done = true
+			continue
+		}
+
+		if line[0] == '.' {
+			line = line[1:]
+		}
+		d.line = line
+	}
+
+	n := copy(p, d.line)
+	d.line = d.line[n:]
+	return n, nil
+}
+
 func (conn connection) write(format string, args ...interface{}) {
-	conn.PrintfLine(format, args...)
+	line := fmt.Sprintf(format, args...)
+	conn.session.countError(line)
+
+	if err := conn.PrintfLine("%s", line); err != nil {
+		conn.session.logger.Warn("write", slog.Any("err", err))
+		return
+	}
+
+	conn.session.logger.Debug("reply", slog.String("line", line))
+	conn.session.reply(line)
 }
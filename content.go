@@ -0,0 +1,91 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+)
+
+// checkContent runs the checks configured for a message, given its header
+// section and, if the whole message is available, a function returning a reader
+// of it. It records the results in msg, and returns a reply to reject the
+// message with or an empty string if it is accepted.
+func (s *Server) checkContent(sess *session, msg *Message, header []byte, whole func() (io.Reader, error)) string {
+	if s.tooManyHops(header) {
+		return rTOO_MANY_HOPS
+	}
+
+	msg.SPF = sess.spf.result
+
+	if s.VerifyDKIM && whole != nil {
+		r, err := whole()
+		if err != nil {
+			sess.logger.Error("DATA", slog.Any("err", err))
+			return rLOCAL_ERROR
+		}
+
+		ctx, cancel := context.WithTimeout(sess.ctx, lookupTimeout)
+		msg.DKIM, err = VerifyDKIM(ctx, s.resolver(), r)
+		cancel()
+
+		if err != nil {
+			sess.logger.Error("DKIM", slog.Any("err", err))
+			return rLOCAL_ERROR
+		}
+		if msg.DKIM == nil {
+			msg.DKIM = []DKIMResult{}
+		}
+	}
+
+	if s.VerifyARC && whole != nil {
+		r, err := whole()
+		if err != nil {
+			sess.logger.Error("DATA", slog.Any("err", err))
+			return rLOCAL_ERROR
+		}
+
+		ctx, cancel := context.WithTimeout(sess.ctx, lookupTimeout)
+		msg.ARC, err = VerifyARC(ctx, s.resolver(), r)
+		cancel()
+
+		if err != nil {
+			sess.logger.Error("ARC", slog.Any("err", err))
+			return rLOCAL_ERROR
+		}
+	}
+
+	if s.VerifyDMARC {
+		msg.DMARC = s.checkDMARC(sess, msg, header)
+
+		if s.EnforceDMARC && msg.DMARC.Status == DMARCFail && msg.DMARC.Policy == DMARCPolicyReject {
+			sess.logger.Info("message rejected", slog.String("dmarc", msg.DMARC.Domain))
+			return rDMARC_REJECTED
+		}
+	}
+
+	return ""
+}
+
+func (s *Server) checkDMARC(sess *session, msg *Message, header []byte) DMARCResult {
+	from, err := fromDomain(header)
+	if err != nil {
+		return DMARCResult{Status: DMARCPermError, Err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(sess.ctx, lookupTimeout)
+	defer cancel()
+
+	result := CheckDMARC(ctx, s.resolver(), from, msg.SPF, sess.spf.domain, msg.DKIM)
+
+	// Without the DKIM results a message that would pass may appear to fail.
+	if msg.DKIM == nil && result.Status == DMARCFail {
+		result.Status = DMARCTempError
+		result.Err = errors.New("dmarc: DKIM signatures were not verified")
+	}
+	if result.Err != nil {
+		sess.logger.Info("dmarc", slog.String("result", string(result.Status)), slog.Any("err", result.Err))
+	}
+
+	return result
+}
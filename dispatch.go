@@ -0,0 +1,138 @@
+package smtp
+
+import "time"
+
+const (
+	defaultWorkers   = 1
+	defaultQueueSize = 100
+)
+
+// handler is a registered Handler along with an optional semaphore limiting how
+// many Messages it may process at once.
+type handler struct {
+	fn  Handler
+	sem chan struct{}
+}
+
+func (h *handler) run(msg Message) (err error) {
+	if h.sem != nil {
+		h.sem <- struct{}{}
+		defer func() { <-h.sem }()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(r)
+		}
+	}()
+
+	h.fn(msg)
+	return nil
+}
+
+// dispatch queues the Message to be passed to the Handlers, returning false if
+// the queue is full or the Server is closed.
+func (s *Server) dispatch(msg Message) bool {
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.workers.Do(s.startWorkers)
+
+	select {
+	case s.queue <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) startWorkers() {
+	workers, size := s.Workers, s.QueueSize
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+
+	s.queue = make(chan Message, size)
+	s.running.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+}
+
+// work handles queued Messages until the Server is closed, then handles those
+// left in the queue, as they have already been accepted.
+func (s *Server) work() {
+	defer s.running.Done()
+
+	for {
+		select {
+		case msg := <-s.queue:
+			s.handle(msg)
+		case <-s.quit:
+			for {
+				select {
+				case msg := <-s.queue:
+					s.handle(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// handle passes the Message to the Handlers, or to the Postmaster for its
+// recipients. However it is split it is recorded as a single Message.
+func (s *Server) handle(msg Message) {
+	s.mu.RLock()
+	handlers := s.handlers
+	s.mu.RUnlock()
+
+	var first error
+	started := time.Now()
+
+	postmaster, rest := s.routePostmaster(msg.Recipients)
+	if len(postmaster) > 0 {
+		part := msg
+		part.Recipients = postmaster
+		first = s.run([]*handler{{fn: s.Postmaster}}, part)
+	}
+
+	if len(postmaster) == 0 || len(rest) > 0 {
+		part := msg
+		part.Recipients = rest
+		if err := s.run(handlers, part); first == nil {
+			first = err
+		}
+	}
+
+	s.Metrics.handler(time.Since(started))
+
+	if s.Hooks != nil {
+		s.Hooks.OnMessage(msg.Context(), msg, time.Since(started), first)
+	}
+}
+
+// run passes the Message to each of the handlers, returning the first error
+// that occurred.
+func (s *Server) run(handlers []*handler, msg Message) error {
+	var first error
+
+	for _, h := range handlers {
+		if err := h.run(msg); err != nil {
+			s.report(s.logger(), err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
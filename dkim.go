@@ -0,0 +1,667 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A DKIMStatus is the outcome of verifying a DKIM signature, using the result
+// names from RFC 8601 section 2.7.1.
+type DKIMStatus string
+
+const (
+	DKIMPass      DKIMStatus = "pass"
+	DKIMFail      DKIMStatus = "fail"
+	DKIMTempError DKIMStatus = "temperror"
+	DKIMPermError DKIMStatus = "permerror"
+)
+
+// maxDKIMSignatures is the number of DKIM-Signature fields that will be
+// verified for a single message, any others are ignored.
+const maxDKIMSignatures = 8
+
+// A DKIMResult is the result of verifying a single DKIM-Signature.
+type DKIMResult struct {
+	Status DKIMStatus
+
+	// Domain, Selector and Identifier are the d=, s= and i= tags of the
+	// signature.
+	Domain     string
+	Selector   string
+	Identifier string
+
+	// Err explains why a signature did not pass.
+	Err error
+}
+
+// VerifyDKIM verifies the DKIM signatures, as described in RFC 6376, of the
+// message read from r, looking up keys with resolver. Lines may end with CRLF
+// or LF. A result is returned for each signature found.
+func VerifyDKIM(ctx context.Context, resolver TXTResolver, r io.Reader) ([]DKIMResult, error) {
+	br := bufio.NewReader(r)
+
+	fields, err := readFields(br)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs []*dkimVerification
+	for i, field := range fields {
+		if !strings.EqualFold(field.name(), "DKIM-Signature") {
+			continue
+		}
+		if len(sigs) == maxDKIMSignatures {
+			break
+		}
+
+		sigs = append(sigs, newDKIMVerification(fields, i))
+	}
+
+	if len(sigs) == 0 {
+		io.Copy(io.Discard, br)
+		return nil, nil
+	}
+
+	var bodies []*bodyCanonicalizer
+	for _, sig := range sigs {
+		if sig.body != nil {
+			bodies = append(bodies, sig.body)
+		}
+	}
+	if err := canonicalizeBodies(br, bodies); err != nil {
+		return nil, err
+	}
+
+	results := make([]DKIMResult, len(sigs))
+	for i, sig := range sigs {
+		results[i] = sig.verify(ctx, resolver)
+	}
+
+	return results, nil
+}
+
+// A headerField is a single field from the header of a message, with any
+// folding kept and lines ending in CRLF.
+type headerField string
+
+func (f headerField) name() string {
+	name, _, _ := strings.Cut(string(f), ":")
+	return strings.TrimRight(name, " \t")
+}
+
+func (f headerField) value() string {
+	_, value, _ := strings.Cut(string(f), ":")
+	return strings.TrimSuffix(value, "\r\n")
+}
+
+// readFields reads the header section of a message, leaving r positioned at the
+// start of the body.
+func readFields(r *bufio.Reader) ([]headerField, error) {
+	var fields []headerField
+	var current strings.Builder
+	size := 0
+
+	for {
+		line, err := r.ReadString('\n')
+		size += len(line)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if size > maxHeaderSize {
+			return nil, errors.New("dkim: header too large")
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if current.Len() > 0 && (line == "" || (line[0] != ' ' && line[0] != '\t')) {
+			fields = append(fields, headerField(current.String()))
+			current.Reset()
+		}
+
+		if line == "" {
+			return fields, nil
+		}
+
+		current.WriteString(line + "\r\n")
+
+		if err == io.EOF {
+			fields = append(fields, headerField(current.String()))
+			return fields, nil
+		}
+	}
+}
+
+// parseTags parses a tag-list, as used for DKIM-Signature fields and key
+// records.
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %q", strings.TrimSpace(part))
+		}
+
+		name = strings.TrimSpace(name)
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(unfold(value))
+	}
+
+	return tags, nil
+}
+
+func unfold(s string) string {
+	return strings.NewReplacer("\r\n", "", "\n", "").Replace(s)
+}
+
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// canonicalizeHeader returns field in the simple or relaxed header
+// canonicalization of RFC 6376 section 3.4, ending with CRLF.
+func canonicalizeHeader(field headerField, relaxed bool) string {
+	if !relaxed {
+		return string(field)
+	}
+
+	name := strings.ToLower(strings.TrimSpace(field.name()))
+	value := compressWhitespace(unfold(field.value()))
+	return name + ":" + strings.TrimSpace(value) + "\r\n"
+}
+
+func compressWhitespace(s string) string {
+	var b strings.Builder
+	space := false
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
+
+// removeSignature returns the field with the value of its b= tag removed, for
+// computing the header hash.
+func removeSignature(field headerField) headerField {
+	name, value, _ := strings.Cut(string(field), ":")
+
+	parts := strings.Split(value, ";")
+	for i, part := range parts {
+		tag, _, ok := strings.Cut(part, "=")
+		if ok && strings.TrimSpace(unfold(tag)) == "b" {
+			parts[i] = part[:strings.IndexByte(part, '=')+1]
+			if strings.HasSuffix(value, "\r\n") && i == len(parts)-1 {
+				parts[i] += "\r\n"
+			}
+		}
+	}
+
+	return headerField(name + ":" + strings.Join(parts, ";"))
+}
+
+// selectFields returns the fields named in names, in order, where a repeated
+// name selects the next instance from the bottom of the header. Names with no
+// remaining instance are skipped.
+func selectFields(fields []headerField, names []string) []headerField {
+	used := map[int]bool{}
+	var selected []headerField
+
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name(), name) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// headerHash computes the hash of the selected fields followed by the
+// signature field with its b= tag removed.
+func headerHash(fields []headerField, names []string, sigField headerField, relaxed bool) []byte {
+	h := sha256.New()
+	for _, field := range selectFields(fields, names) {
+		io.WriteString(h, canonicalizeHeader(field, relaxed))
+	}
+	io.WriteString(h, strings.TrimSuffix(canonicalizeHeader(removeSignature(sigField), relaxed), "\r\n"))
+
+	return h.Sum(nil)
+}
+
+// A bodyCanonicalizer writes the simple or relaxed body canonicalization of RFC
+// 6376 section 3.4 to a hash, one line at a time.
+type bodyCanonicalizer struct {
+	hash    hash.Hash
+	relaxed bool
+	limit   int64
+
+	written    int64
+	emptyLines int
+	any        bool
+}
+
+func newBodyCanonicalizer(relaxed bool, limit int64) *bodyCanonicalizer {
+	return &bodyCanonicalizer{hash: sha256.New(), relaxed: relaxed, limit: limit}
+}
+
+func (c *bodyCanonicalizer) line(line []byte) {
+	if c.relaxed {
+		line = bytes.TrimRight([]byte(compressWhitespace(string(line))), " ")
+	}
+
+	if len(line) == 0 {
+		c.emptyLines++
+		return
+	}
+
+	for ; c.emptyLines > 0; c.emptyLines-- {
+		c.write([]byte("\r\n"))
+	}
+	c.write(line)
+	c.write([]byte("\r\n"))
+	c.any = true
+}
+
+func (c *bodyCanonicalizer) write(p []byte) {
+	if c.limit >= 0 && c.written+int64(len(p)) > c.limit {
+		p = p[:c.limit-c.written]
+	}
+
+	c.hash.Write(p)
+	c.written += int64(len(p))
+}
+
+// sum returns the body hash, after all lines have been written.
+func (c *bodyCanonicalizer) sum() []byte {
+	if !c.any && !c.relaxed {
+		c.write([]byte("\r\n"))
+	}
+
+	return c.hash.Sum(nil)
+}
+
+// canonicalizeBodies reads the body from r passing each line to each of bodies.
+func canonicalizeBodies(r *bufio.Reader, bodies []*bodyCanonicalizer) error {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			for _, body := range bodies {
+				body.line(line)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// dkimSignature holds the parsed tags of a DKIM-Signature field.
+type dkimSignature struct {
+	algorithm     string
+	signature     []byte
+	bodyHash      []byte
+	headerRelaxed bool
+	bodyRelaxed   bool
+	domain        string
+	headers       []string
+	identifier    string
+	length        int64
+	selector      string
+	timestamp     time.Time
+	expiration    time.Time
+}
+
+func parseDKIMSignature(value string) (*dkimSignature, error) {
+	tags, err := parseTags(value)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+
+	if err := requireTags(tags, "v", "a", "b", "bh", "d", "h", "s"); err != nil {
+		return nil, fmt.Errorf("dkim: %w", err)
+	}
+
+	if tags["v"] != "1" {
+		return nil, fmt.Errorf("dkim: unsupported version %q", tags["v"])
+	}
+
+	sig, err := parseSignatureTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	fromSigned := false
+	for _, name := range sig.headers {
+		if strings.EqualFold(name, "From") {
+			fromSigned = true
+		}
+	}
+	if !fromSigned {
+		return nil, errors.New("dkim: From field not signed")
+	}
+
+	sig.identifier = tags["i"]
+	if sig.identifier == "" {
+		sig.identifier = "@" + sig.domain
+	}
+	_, idDomain := splitAddress(sig.identifier)
+	if !strings.EqualFold(idDomain, sig.domain) && !hasSuffixFold(idDomain, "."+sig.domain) {
+		return nil, errors.New("dkim: i= domain is not within d=")
+	}
+
+	return sig, nil
+}
+
+func requireTags(tags map[string]string, names ...string) error {
+	for _, name := range names {
+		if _, ok := tags[name]; !ok {
+			return fmt.Errorf("missing tag %s=", name)
+		}
+	}
+
+	return nil
+}
+
+// parseSignatureTags parses the tags shared by DKIM-Signature and
+// ARC-Message-Signature fields.
+func parseSignatureTags(tags map[string]string) (*dkimSignature, error) {
+	var err error
+
+	sig := &dkimSignature{
+		algorithm: strings.ToLower(tags["a"]),
+		domain:    strings.ToLower(tags["d"]),
+		selector:  tags["s"],
+		length:    -1,
+	}
+
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return nil, fmt.Errorf("dkim: unsupported algorithm %q", tags["a"])
+	}
+
+	if sig.signature, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["b"])); err != nil {
+		return nil, errors.New("dkim: invalid b= tag")
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"])); err != nil {
+		return nil, errors.New("dkim: invalid bh= tag")
+	}
+
+	if c, ok := tags["c"]; ok {
+		header, body, _ := strings.Cut(strings.ToLower(c), "/")
+		if body == "" {
+			body = "simple"
+		}
+		if (header != "simple" && header != "relaxed") || (body != "simple" && body != "relaxed") {
+			return nil, fmt.Errorf("dkim: unsupported canonicalization %q", c)
+		}
+		sig.headerRelaxed = header == "relaxed"
+		sig.bodyRelaxed = body == "relaxed"
+	}
+
+	for _, name := range strings.Split(stripWhitespace(tags["h"]), ":") {
+		if name != "" {
+			sig.headers = append(sig.headers, name)
+		}
+	}
+
+	if l, ok := tags["l"]; ok {
+		if sig.length, err = strconv.ParseInt(l, 10, 64); err != nil || sig.length < 0 {
+			return nil, errors.New("dkim: invalid l= tag")
+		}
+	}
+
+	if q, ok := tags["q"]; ok && !strings.Contains(strings.ToLower(q), "dns/txt") {
+		return nil, fmt.Errorf("dkim: unsupported query method %q", q)
+	}
+
+	if t, ok := tags["t"]; ok {
+		secs, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return nil, errors.New("dkim: invalid t= tag")
+		}
+		sig.timestamp = time.Unix(secs, 0)
+	}
+
+	if x, ok := tags["x"]; ok {
+		secs, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return nil, errors.New("dkim: invalid x= tag")
+		}
+		sig.expiration = time.Unix(secs, 0)
+		if !sig.timestamp.IsZero() && !sig.expiration.After(sig.timestamp) {
+			return nil, errors.New("dkim: x= is not after t=")
+		}
+	}
+
+	return sig, nil
+}
+
+// dkimVerification tracks the verification of a single signature.
+type dkimVerification struct {
+	fields []headerField
+	field  headerField
+	sig    *dkimSignature
+	body   *bodyCanonicalizer
+	err    error
+}
+
+func newDKIMVerification(fields []headerField, i int) *dkimVerification {
+	return newSignatureVerification(fields, fields[i], parseDKIMSignature)
+}
+
+func newSignatureVerification(fields []headerField, field headerField, parse func(string) (*dkimSignature, error)) *dkimVerification {
+	v := &dkimVerification{fields: fields, field: field}
+
+	v.sig, v.err = parse(field.value())
+	if v.err == nil {
+		v.body = newBodyCanonicalizer(v.sig.bodyRelaxed, v.sig.length)
+	}
+
+	return v
+}
+
+func (v *dkimVerification) verify(ctx context.Context, resolver TXTResolver) DKIMResult {
+	if v.err != nil {
+		return DKIMResult{Status: DKIMPermError, Err: v.err}
+	}
+
+	sig := v.sig
+	result := DKIMResult{Domain: sig.domain, Selector: sig.selector, Identifier: sig.identifier}
+
+	fail := func(status DKIMStatus, err error) DKIMResult {
+		result.Status, result.Err = status, err
+		return result
+	}
+
+	if !sig.expiration.IsZero() && time.Now().After(sig.expiration) {
+		return fail(DKIMFail, errors.New("dkim: signature expired"))
+	}
+
+	if !bytes.Equal(v.body.sum(), sig.bodyHash) {
+		return fail(DKIMFail, errors.New("dkim: body hash did not verify"))
+	}
+
+	key, err := lookupDKIMKey(ctx, resolver, sig.selector, sig.domain)
+	if err != nil {
+		if isNotFound(err) || errors.Is(err, errDKIMKey) {
+			return fail(DKIMPermError, err)
+		}
+		return fail(DKIMTempError, err)
+	}
+
+	if key.strict && sig.identifier != "" && !strings.EqualFold(sig.identifier[strings.LastIndexByte(sig.identifier, '@')+1:], sig.domain) {
+		return fail(DKIMPermError, errors.New("dkim: key requires i= domain to equal d="))
+	}
+
+	hashed := headerHash(v.fields, sig.headers, v.field, sig.headerRelaxed)
+	if err := key.verify(sig.algorithm, hashed, sig.signature); err != nil {
+		return fail(DKIMFail, err)
+	}
+
+	result.Status = DKIMPass
+	return result
+}
+
+var errDKIMKey = errors.New("dkim: invalid key record")
+
+// dkimKey is a public key published in DNS.
+type dkimKey struct {
+	rsa     *rsa.PublicKey
+	ed25519 ed25519.PublicKey
+	strict  bool
+}
+
+func lookupDKIMKey(ctx context.Context, resolver TXTResolver, selector, domain string) (*dkimKey, error) {
+	txts, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(txts) == 0 {
+		return nil, fmt.Errorf("%w: no key for %s._domainkey.%s", errDKIMKey, selector, domain)
+	}
+
+	return parseDKIMKey(strings.Join(txts, ""))
+}
+
+func parseDKIMKey(record string) (*dkimKey, error) {
+	tags, err := parseTags(record)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errDKIMKey, err)
+	}
+
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("%w: unsupported version %q", errDKIMKey, v)
+	}
+
+	if h, ok := tags["h"]; ok && !strings.Contains(strings.ToLower(h), "sha256") {
+		return nil, fmt.Errorf("%w: key does not allow sha256", errDKIMKey)
+	}
+
+	if s, ok := tags["s"]; ok {
+		services := strings.Split(stripWhitespace(s), ":")
+		if !contains(services, "*") && !contains(services, "email") {
+			return nil, fmt.Errorf("%w: key not for email", errDKIMKey)
+		}
+	}
+
+	p := stripWhitespace(tags["p"])
+	if p == "" {
+		return nil, fmt.Errorf("%w: key revoked", errDKIMKey)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid p= tag", errDKIMKey)
+	}
+
+	key := &dkimKey{}
+	for _, flag := range strings.Split(stripWhitespace(tags["t"]), ":") {
+		if flag == "s" {
+			key.strict = true
+		}
+	}
+
+	switch k := strings.ToLower(tags["k"]); k {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			if pub, err = x509.ParsePKCS1PublicKey(data); err != nil {
+				return nil, fmt.Errorf("%w: invalid rsa key", errDKIMKey)
+			}
+		}
+
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: not an rsa key", errDKIMKey)
+		}
+		if rsaKey.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("%w: rsa key too short", errDKIMKey)
+		}
+		key.rsa = rsaKey
+
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: invalid ed25519 key", errDKIMKey)
+		}
+		key.ed25519 = ed25519.PublicKey(data)
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported key type %q", errDKIMKey, k)
+	}
+
+	return key, nil
+}
+
+func (k *dkimKey) verify(algorithm string, hashed, signature []byte) error {
+	switch {
+	case algorithm == "rsa-sha256" && k.rsa != nil:
+		if err := rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, hashed, signature); err != nil {
+			return errors.New("dkim: signature did not verify")
+		}
+		return nil
+
+	case algorithm == "ed25519-sha256" && k.ed25519 != nil:
+		if !ed25519.Verify(k.ed25519, hashed, signature) {
+			return errors.New("dkim: signature did not verify")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("dkim: key does not match algorithm %s", algorithm)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
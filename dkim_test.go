@@ -0,0 +1,121 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The example from RFC 8463 Appendix A, signed with both an ed25519 and an RSA
+// key.
+const dkimMessage = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=test; t=1528637909; h=from : to : subject :
+ date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3
+ DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz
+ dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+
+var dkimResolver = TestResolver{TXT: map[string][]string{
+	"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+	"test._domainkey.football.example.com":     {"v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB"},
+}}
+
+func statuses(results []DKIMResult) []DKIMStatus {
+	var s []DKIMStatus
+	for _, result := range results {
+		s = append(s, result.Status)
+	}
+	return s
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	results, err := VerifyDKIM(context.Background(), dkimResolver, strings.NewReader(dkimMessage))
+	assert.Nil(t, err)
+
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, DKIMResult{Status: DKIMPass, Domain: "football.example.com", Selector: "brisbane", Identifier: "@football.example.com"}, results[0])
+		assert.Equal(t, DKIMResult{Status: DKIMPass, Domain: "football.example.com", Selector: "test", Identifier: "@football.example.com"}, results[1])
+	}
+}
+
+func TestVerifyDKIMWithCRLF(t *testing.T) {
+	msg := strings.ReplaceAll(dkimMessage, "\n", "\r\n")
+
+	results, err := VerifyDKIM(context.Background(), dkimResolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMStatus{DKIMPass, DKIMPass}, statuses(results))
+}
+
+func TestVerifyDKIMWithRelaxedChanges(t *testing.T) {
+	msg := strings.Replace(dkimMessage, "Subject: Is dinner ready?", "subject:   Is  dinner ready? ", 1)
+	msg = strings.Replace(msg, "Joe.\n", "Joe.  \n\n\n", 1)
+
+	results, err := VerifyDKIM(context.Background(), dkimResolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMStatus{DKIMPass, DKIMPass}, statuses(results))
+}
+
+func TestVerifyDKIMWithModifiedBody(t *testing.T) {
+	msg := strings.Replace(dkimMessage, "We lost", "We won", 1)
+
+	results, err := VerifyDKIM(context.Background(), dkimResolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMStatus{DKIMFail, DKIMFail}, statuses(results))
+}
+
+func TestVerifyDKIMWithModifiedHeader(t *testing.T) {
+	msg := strings.Replace(dkimMessage, "Is dinner ready?", "Is lunch ready?", 1)
+
+	results, err := VerifyDKIM(context.Background(), dkimResolver, strings.NewReader(msg))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMStatus{DKIMFail, DKIMFail}, statuses(results))
+}
+
+func TestVerifyDKIMWithMissingKey(t *testing.T) {
+	resolver := TestResolver{TXT: map[string][]string{
+		"test._domainkey.football.example.com": dkimResolver.TXT["test._domainkey.football.example.com"],
+	}}
+
+	results, err := VerifyDKIM(context.Background(), resolver, strings.NewReader(dkimMessage))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMStatus{DKIMPermError, DKIMPass}, statuses(results))
+}
+
+func TestVerifyDKIMWithRevokedKey(t *testing.T) {
+	resolver := TestResolver{TXT: map[string][]string{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p="},
+	}}
+
+	results, err := VerifyDKIM(context.Background(), resolver, strings.NewReader(dkimMessage))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMStatus{DKIMPermError, DKIMPermError}, statuses(results))
+}
+
+func TestVerifyDKIMWithoutSignature(t *testing.T) {
+	results, err := VerifyDKIM(context.Background(), dkimResolver, strings.NewReader("Subject: hi\n\nhello\n"))
+	assert.Nil(t, err)
+	assert.Empty(t, results)
+}
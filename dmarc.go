@@ -0,0 +1,239 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	netmail "net/mail"
+	"strconv"
+	"strings"
+)
+
+// A DMARCStatus is the outcome of evaluating a DMARC policy, using the result
+// names from RFC 8601 section 2.7.1.
+type DMARCStatus string
+
+const (
+	DMARCNone      DMARCStatus = "none"
+	DMARCPass      DMARCStatus = "pass"
+	DMARCFail      DMARCStatus = "fail"
+	DMARCTempError DMARCStatus = "temperror"
+	DMARCPermError DMARCStatus = "permerror"
+)
+
+// A DMARCPolicy is the handling a domain asks for messages that fail DMARC.
+type DMARCPolicy string
+
+const (
+	DMARCPolicyNone       DMARCPolicy = "none"
+	DMARCPolicyQuarantine DMARCPolicy = "quarantine"
+	DMARCPolicyReject     DMARCPolicy = "reject"
+)
+
+// A DMARCResult is the result of evaluating the DMARC policy for a message.
+type DMARCResult struct {
+	Status DMARCStatus
+
+	// Domain is the domain of the RFC5322.From address.
+	Domain string
+
+	// Policy is the policy published for Domain, or for its organizational
+	// domain, with any pct= sampling applied to messages that fail. It is empty
+	// if no policy was found.
+	Policy DMARCPolicy
+
+	// SPFAligned and DKIMAligned report whether SPF, or any DKIM signature,
+	// passed for a domain aligned with Domain.
+	SPFAligned  bool
+	DKIMAligned bool
+
+	// Err explains why the policy could not be evaluated.
+	Err error
+}
+
+// CheckDMARC evaluates the DMARC policy, as described in RFC 7489, for a
+// message with an RFC5322.From address in the domain from. The spf result is
+// for spfDomain, the domain of the MAIL FROM address or the HELO name, and dkim
+// holds the results of verifying the message's signatures. Policies are looked
+// up with resolver.
+func CheckDMARC(ctx context.Context, resolver TXTResolver, from string, spf SPFResult, spfDomain string, dkim []DKIMResult) DMARCResult {
+	from = strings.ToLower(strings.TrimSuffix(from, "."))
+	result := DMARCResult{Status: DMARCNone, Domain: from}
+
+	record, err := lookupDMARC(ctx, resolver, from)
+	if err != nil {
+		result.Status, result.Err = DMARCTempError, err
+		return result
+	}
+
+	var policy DMARCPolicy
+	if record != nil {
+		policy = record.policy
+	} else if org := organizationalDomain(from); org != from {
+		record, err = lookupDMARC(ctx, resolver, org)
+		if err != nil {
+			result.Status, result.Err = DMARCTempError, err
+			return result
+		}
+		if record != nil {
+			policy = record.policy
+			if record.subdomainPolicy != "" {
+				policy = record.subdomainPolicy
+			}
+		}
+	}
+
+	if record == nil {
+		return result
+	}
+
+	result.SPFAligned = spf == SPFPass && aligned(spfDomain, from, record.strictSPF)
+	for _, sig := range dkim {
+		if sig.Status == DKIMPass && aligned(sig.Domain, from, record.strictDKIM) {
+			result.DKIMAligned = true
+		}
+	}
+
+	result.Policy = policy
+	if result.SPFAligned || result.DKIMAligned {
+		result.Status = DMARCPass
+		return result
+	}
+
+	result.Status = DMARCFail
+	if record.percent < 100 && rand.Intn(100) >= record.percent {
+		switch policy {
+		case DMARCPolicyReject:
+			result.Policy = DMARCPolicyQuarantine
+		case DMARCPolicyQuarantine:
+			result.Policy = DMARCPolicyNone
+		}
+	}
+
+	return result
+}
+
+// aligned reports whether domain is aligned with from, as described in RFC
+// 7489 section 3.1.
+func aligned(domain, from string, strict bool) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+
+	if strict {
+		return domain == from
+	}
+
+	return organizationalDomain(domain) == organizationalDomain(from)
+}
+
+// A dmarcRecord is a DMARC policy record.
+type dmarcRecord struct {
+	policy          DMARCPolicy
+	subdomainPolicy DMARCPolicy
+	strictDKIM      bool
+	strictSPF       bool
+	percent         int
+}
+
+// lookupDMARC returns the DMARC policy record published for domain, or nil if
+// there is not exactly one valid record.
+func lookupDMARC(ctx context.Context, resolver TXTResolver, domain string) (*dmarcRecord, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if txt == "v=DMARC1" || strings.HasPrefix(txt, "v=DMARC1;") || strings.HasPrefix(txt, "v=DMARC1 ") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) != 1 {
+		return nil, nil
+	}
+
+	return parseDMARCRecord(records[0]), nil
+}
+
+// parseDMARCRecord parses a DMARC policy record, returning nil if it is not
+// valid.
+func parseDMARCRecord(record string) *dmarcRecord {
+	tags, err := parseTags(record)
+	if err != nil {
+		return nil
+	}
+
+	r := &dmarcRecord{
+		policy:          DMARCPolicy(strings.ToLower(tags["p"])),
+		subdomainPolicy: DMARCPolicy(strings.ToLower(tags["sp"])),
+		strictDKIM:      strings.EqualFold(tags["adkim"], "s"),
+		strictSPF:       strings.EqualFold(tags["aspf"], "s"),
+		percent:         100,
+	}
+
+	if !validDMARCPolicy(r.policy) {
+		return nil
+	}
+	if r.subdomainPolicy != "" && !validDMARCPolicy(r.subdomainPolicy) {
+		r.subdomainPolicy = ""
+	}
+
+	if pct, ok := tags["pct"]; ok {
+		if n, err := strconv.Atoi(pct); err == nil && n >= 0 && n <= 100 {
+			r.percent = n
+		}
+	}
+
+	return r
+}
+
+func validDMARCPolicy(p DMARCPolicy) bool {
+	return p == DMARCPolicyNone || p == DMARCPolicyQuarantine || p == DMARCPolicyReject
+}
+
+// fromDomain returns the domain of the RFC5322.From address in header. The
+// message must have a single From field, and all of its addresses must be in
+// the same domain.
+func fromDomain(header []byte) (string, error) {
+	fields, err := readFields(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return "", err
+	}
+
+	var from []headerField
+	for _, field := range fields {
+		if strings.EqualFold(field.name(), "From") {
+			from = append(from, field)
+		}
+	}
+	if len(from) != 1 {
+		return "", errors.New("dmarc: message must have one From field")
+	}
+
+	addrs, err := netmail.ParseAddressList(unfold(from[0].value()))
+	if err != nil {
+		return "", fmt.Errorf("dmarc: invalid From field: %w", err)
+	}
+
+	var domain string
+	for _, addr := range addrs {
+		_, d := splitAddress(addr.Address)
+		d = strings.ToLower(d)
+
+		if d == "" || (domain != "" && d != domain) {
+			return "", errors.New("dmarc: From field must have addresses in one domain")
+		}
+		domain = d
+	}
+
+	return domain, nil
+}
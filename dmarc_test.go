@@ -0,0 +1,125 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrganizationalDomain(t *testing.T) {
+	testCases := map[string]string{
+		"example.com":             "example.com",
+		"mail.example.com":        "example.com",
+		"a.b.mail.example.com":    "example.com",
+		"Mail.Example.COM.":       "example.com",
+		"example.co.uk":           "example.co.uk",
+		"mail.example.co.uk":      "example.co.uk",
+		"co.uk":                   "co.uk",
+		"com":                     "com",
+		"foo.bar.example.invalid": "example.invalid",
+		"a.b.c.kawasaki.jp":       "b.c.kawasaki.jp",
+		"a.city.kawasaki.jp":      "city.kawasaki.jp",
+	}
+
+	for domain, expected := range testCases {
+		assert.Equal(t, expected, organizationalDomain(domain), domain)
+	}
+}
+
+func TestCheckDMARC(t *testing.T) {
+	resolver := TestResolver{TXT: map[string][]string{
+		"_dmarc.example.com":        {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.example":     {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+		"_dmarc.none.example":       {"v=DMARC1; p=none"},
+		"_dmarc.two.example":        {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		"_dmarc.invalid.example":    {"v=DMARC1; p=bounce"},
+		"_dmarc.sampled.example":    {"v=DMARC1; p=reject; pct=0"},
+		"_dmarc.other.example":      {"some other record"},
+		"_dmarc.mail.other.example": {"v=DMARC1; p=quarantine"},
+	}}
+
+	passing := func(domain string) []DKIMResult {
+		return []DKIMResult{{Status: DKIMFail, Domain: "example.net"}, {Status: DKIMPass, Domain: domain}}
+	}
+
+	testCases := []struct {
+		name      string
+		from      string
+		spf       SPFResult
+		spfDomain string
+		dkim      []DKIMResult
+		expected  DMARCResult
+	}{
+		{"spf aligned", "example.com", SPFPass, "example.com", nil,
+			DMARCResult{Status: DMARCPass, Domain: "example.com", Policy: DMARCPolicyReject, SPFAligned: true}},
+		{"spf relaxed", "example.com", SPFPass, "bounces.example.com", nil,
+			DMARCResult{Status: DMARCPass, Domain: "example.com", Policy: DMARCPolicyReject, SPFAligned: true}},
+		{"spf not passing", "example.com", SPFSoftFail, "example.com", nil,
+			DMARCResult{Status: DMARCFail, Domain: "example.com", Policy: DMARCPolicyReject}},
+		{"spf unaligned", "example.com", SPFPass, "example.net", nil,
+			DMARCResult{Status: DMARCFail, Domain: "example.com", Policy: DMARCPolicyReject}},
+		{"dkim aligned", "example.com", SPFNone, "", passing("example.com"),
+			DMARCResult{Status: DMARCPass, Domain: "example.com", Policy: DMARCPolicyReject, DKIMAligned: true}},
+		{"dkim unaligned", "example.com", SPFNone, "", passing("example.org"),
+			DMARCResult{Status: DMARCFail, Domain: "example.com", Policy: DMARCPolicyReject}},
+		{"subdomain policy", "mail.example.com", SPFNone, "", nil,
+			DMARCResult{Status: DMARCFail, Domain: "mail.example.com", Policy: DMARCPolicyQuarantine}},
+		{"strict spf", "strict.example", SPFPass, "mail.strict.example", nil,
+			DMARCResult{Status: DMARCFail, Domain: "strict.example", Policy: DMARCPolicyReject}},
+		{"strict dkim", "mail.strict.example", SPFNone, "", passing("strict.example"),
+			DMARCResult{Status: DMARCFail, Domain: "mail.strict.example", Policy: DMARCPolicyReject}},
+		{"policy none", "none.example", SPFFail, "none.example", nil,
+			DMARCResult{Status: DMARCFail, Domain: "none.example", Policy: DMARCPolicyNone}},
+		{"no record", "example.org", SPFPass, "example.org", nil,
+			DMARCResult{Status: DMARCNone, Domain: "example.org"}},
+		{"two records", "two.example", SPFFail, "two.example", nil,
+			DMARCResult{Status: DMARCNone, Domain: "two.example"}},
+		{"invalid record", "invalid.example", SPFFail, "invalid.example", nil,
+			DMARCResult{Status: DMARCNone, Domain: "invalid.example"}},
+		{"sampled", "sampled.example", SPFFail, "sampled.example", nil,
+			DMARCResult{Status: DMARCFail, Domain: "sampled.example", Policy: DMARCPolicyQuarantine}},
+		{"other record", "mail.other.example", SPFNone, "", nil,
+			DMARCResult{Status: DMARCFail, Domain: "mail.other.example", Policy: DMARCPolicyQuarantine}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := CheckDMARC(context.Background(), resolver, tc.from, tc.spf, tc.spfDomain, tc.dkim)
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestCheckDMARCWithTempError(t *testing.T) {
+	result := CheckDMARC(context.Background(), errResolver{}, "example.com", SPFPass, "example.com", nil)
+
+	assert.Equal(t, DMARCTempError, result.Status)
+	assert.NotNil(t, result.Err)
+}
+
+type errResolver struct{}
+
+func (errResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, errors.New("timed out")
+}
+
+func TestFromDomain(t *testing.T) {
+	domain, err := fromDomain([]byte("Subject: hi\r\nFrom: Joe\r\n <joe@Example.COM>\r\n\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", domain)
+
+	domain, err = fromDomain([]byte("From: joe@example.com, jane@example.com\n\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "example.com", domain)
+
+	_, err = fromDomain([]byte("From: joe@example.com, jane@example.org\n\n"))
+	assert.NotNil(t, err)
+
+	_, err = fromDomain([]byte("From: joe@example.com\nFrom: jane@example.com\n\n"))
+	assert.NotNil(t, err)
+
+	_, err = fromDomain([]byte("Subject: hi\n\n"))
+	assert.NotNil(t, err)
+}
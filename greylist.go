@@ -0,0 +1,365 @@
+package smtp
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGreylistDelay       = 5 * time.Minute
+	defaultGreylistRetryWindow = 48 * time.Hour
+	defaultGreylistMaxAge      = 35 * 24 * time.Hour
+	defaultGreylistWhitelist   = 5
+)
+
+// A Greylist temporarily rejects the first attempt to deliver mail for each
+// triplet of client network, sender and recipient. Legitimate servers retry,
+// and are accepted once Delay has passed.
+type Greylist struct {
+	// Store records the triplets and clients seen. If nil an in-memory store is
+	// used.
+	Store GreylistStore
+
+	// Delay is how long a client must wait before retrying. If zero it is 5
+	// minutes.
+	Delay time.Duration
+
+	// RetryWindow is how long after the first attempt a retry is accepted, after
+	// which the triplet is forgotten. If zero it is 48 hours.
+	RetryWindow time.Duration
+
+	// MaxAge is how long a triplet, or a whitelisted client, is remembered after
+	// it was last seen. If zero it is 35 days.
+	MaxAge time.Duration
+
+	// WhitelistAfter is the number of retries a client network must pass before
+	// it is no longer greylisted. If zero it is 5; if negative clients are never
+	// whitelisted.
+	WhitelistAfter int
+
+	// AllowSenders lists addresses, or domains, of senders that are never
+	// greylisted.
+	AllowSenders []string
+
+	// AllowNetworks lists client networks that are never greylisted.
+	AllowNetworks []*net.IPNet
+
+	mu      sync.Mutex
+	expired time.Time
+}
+
+// A GreylistRecord is the state kept for a triplet or client network.
+type GreylistRecord struct {
+	// First is when the triplet was first seen, and Last when it was last seen.
+	First time.Time
+	Last  time.Time
+
+	// Passed is the number of times it has been accepted.
+	Passed int
+}
+
+// A GreylistStore stores GreylistRecords. It must be safe to use concurrently.
+type GreylistStore interface {
+	// Get returns the record for key, or false if there is none.
+	Get(key string) (GreylistRecord, bool, error)
+
+	// Put stores the record for key.
+	Put(key string, record GreylistRecord) error
+
+	// Expire removes the records last seen before t.
+	Expire(t time.Time) error
+}
+
+// check reports whether mail from sender to recipient, sent by a client at ip,
+// should be accepted now.
+func (g *Greylist) check(ip net.IP, sender, recipient string, now time.Time) (bool, error) {
+	if g.allowed(ip, sender) {
+		return true, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	store := g.store()
+
+	if now.Sub(g.expired) > time.Hour {
+		if err := store.Expire(now.Add(-g.maxAge())); err != nil {
+			return true, err
+		}
+		g.expired = now
+	}
+
+	network := greylistNetwork(ip)
+	clientKey := "client:" + network
+
+	client, ok, err := store.Get(clientKey)
+	if err != nil {
+		return true, err
+	}
+	if !ok {
+		client = GreylistRecord{First: now}
+	}
+
+	if g.whitelisted(client, now) {
+		client.Last = now
+		return true, store.Put(clientKey, client)
+	}
+
+	key := strings.Join([]string{"triplet", network, strings.ToLower(sender), strings.ToLower(recipient)}, ":")
+
+	record, ok, err := store.Get(key)
+	if err != nil {
+		return true, err
+	}
+
+	switch {
+	case !ok, record.Passed == 0 && now.Sub(record.First) > g.retryWindow(), now.Sub(record.Last) > g.maxAge():
+		return false, store.Put(key, GreylistRecord{First: now, Last: now})
+
+	case record.Passed == 0 && now.Sub(record.First) < g.delay():
+		record.Last = now
+		return false, store.Put(key, record)
+	}
+
+	record.Passed++
+	record.Last = now
+	if err := store.Put(key, record); err != nil {
+		return true, err
+	}
+
+	client.Passed++
+	client.Last = now
+	return true, store.Put(clientKey, client)
+}
+
+func (g *Greylist) allowed(ip net.IP, sender string) bool {
+	for _, network := range g.AllowNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	_, domain := splitAddress(sender)
+	for _, allowed := range g.AllowSenders {
+		if strings.EqualFold(allowed, sender) || strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *Greylist) whitelisted(client GreylistRecord, now time.Time) bool {
+	after := g.WhitelistAfter
+	if after == 0 {
+		after = defaultGreylistWhitelist
+	}
+
+	return after > 0 && client.Passed >= after && now.Sub(client.Last) <= g.maxAge()
+}
+
+func (g *Greylist) store() GreylistStore {
+	if g.Store == nil {
+		g.Store = NewMemoryGreylistStore()
+	}
+
+	return g.Store
+}
+
+func (g *Greylist) delay() time.Duration {
+	if g.Delay == 0 {
+		return defaultGreylistDelay
+	}
+
+	return g.Delay
+}
+
+func (g *Greylist) retryWindow() time.Duration {
+	if g.RetryWindow == 0 {
+		return defaultGreylistRetryWindow
+	}
+
+	return g.RetryWindow
+}
+
+func (g *Greylist) maxAge() time.Duration {
+	if g.MaxAge == 0 {
+		return defaultGreylistMaxAge
+	}
+
+	return g.MaxAge
+}
+
+// greylistNetwork returns the network a client is greylisted as: the /24 for
+// IPv4 and the /64 for IPv6, as large senders retry from different addresses.
+func greylistNetwork(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// MemoryGreylistStore is a GreylistStore that keeps records in memory.
+type MemoryGreylistStore struct {
+	mu      sync.Mutex
+	records map[string]GreylistRecord
+}
+
+func NewMemoryGreylistStore() *MemoryGreylistStore {
+	return &MemoryGreylistStore{records: map[string]GreylistRecord{}}
+}
+
+func (m *MemoryGreylistStore) Get(key string) (GreylistRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record, ok := m.records[key]
+	return record, ok, nil
+}
+
+func (m *MemoryGreylistStore) Put(key string, record GreylistRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.records[key] = record
+	return nil
+}
+
+func (m *MemoryGreylistStore) Expire(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, record := range m.records {
+		if record.Last.Before(t) {
+			delete(m.records, key)
+		}
+	}
+	return nil
+}
+
+// FileGreylistStore is a GreylistStore that keeps records in memory, and logs
+// changes to a file so that they persist across restarts. The file is
+// rewritten when records are expired.
+type FileGreylistStore struct {
+	mem  *MemoryGreylistStore
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+type greylistEntry struct {
+	Key string `json:"key"`
+	GreylistRecord
+}
+
+// OpenFileGreylistStore opens the store kept in the file at path, creating it
+// if it does not exist.
+func OpenFileGreylistStore(path string) (*FileGreylistStore, error) {
+	f := &FileGreylistStore{mem: NewMemoryGreylistStore(), path: path}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry greylistEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A partly written last line is ignored.
+			continue
+		}
+		f.mem.records[entry.Key] = entry.GreylistRecord
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f.file = file
+	return f, nil
+}
+
+func (f *FileGreylistStore) Get(key string) (GreylistRecord, bool, error) {
+	return f.mem.Get(key)
+}
+
+func (f *FileGreylistStore) Put(key string, record GreylistRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.write(f.file, greylistEntry{key, record}); err != nil {
+		return err
+	}
+
+	return f.mem.Put(key, record)
+}
+
+func (f *FileGreylistStore) Expire(t time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.mem.Expire(t)
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	f.mem.mu.Lock()
+	for key, record := range f.mem.records {
+		if err = f.write(tmp, greylistEntry{key, record}); err != nil {
+			break
+		}
+	}
+	f.mem.mu.Unlock()
+
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	f.file.Close()
+	f.file = file
+	return nil
+}
+
+func (f *FileGreylistStore) write(file *os.File, entry greylistEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (f *FileGreylistStore) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
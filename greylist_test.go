@@ -0,0 +1,117 @@
+package smtp
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGreylist(t *testing.T) {
+	g := &Greylist{Delay: time.Minute, RetryWindow: time.Hour, WhitelistAfter: -1}
+
+	ip := net.ParseIP("192.0.2.10")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	check := func(ip net.IP, sender, recipient string, after time.Duration) bool {
+		ok, err := g.check(ip, sender, recipient, start.Add(after))
+		assert.Nil(t, err)
+		return ok
+	}
+
+	assert.False(t, check(ip, "john@example.com", "jane@example.org", 0))
+	assert.False(t, check(ip, "john@example.com", "jane@example.org", 30*time.Second))
+	assert.True(t, check(ip, "john@example.com", "jane@example.org", 2*time.Minute))
+	assert.True(t, check(ip, "JOHN@example.com", "jane@example.org", 3*time.Minute))
+
+	// Retries may come from a different address in the same network.
+	assert.False(t, check(ip, "john@example.com", "other@example.org", 0))
+	assert.True(t, check(net.ParseIP("192.0.2.200"), "john@example.com", "other@example.org", 2*time.Minute))
+	assert.False(t, check(net.ParseIP("198.51.100.10"), "john@example.com", "other@example.org", 2*time.Minute))
+
+	// A retry after the window is treated as a first attempt.
+	assert.False(t, check(ip, "", "jane@example.org", 0))
+	assert.False(t, check(ip, "", "jane@example.org", 2*time.Hour))
+	assert.True(t, check(ip, "", "jane@example.org", 2*time.Hour+2*time.Minute))
+}
+
+func TestGreylistWithWhitelist(t *testing.T) {
+	g := &Greylist{WhitelistAfter: 2}
+
+	ip := net.ParseIP("2001:db8::1")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, recipient := range []string{"a@example.org", "b@example.org"} {
+		ok, _ := g.check(ip, "john@example.com", recipient, start)
+		assert.False(t, ok)
+		ok, _ = g.check(ip, "john@example.com", recipient, start.Add(10*time.Minute))
+		assert.True(t, ok)
+	}
+
+	ok, _ := g.check(net.ParseIP("2001:db8::2"), "jane@example.com", "c@example.org", start.Add(10*time.Minute))
+	assert.True(t, ok)
+
+	ok, _ = g.check(ip, "jane@example.com", "c@example.org", start.Add(40*24*time.Hour))
+	assert.False(t, ok)
+}
+
+func TestGreylistWithAllowlists(t *testing.T) {
+	_, network, _ := net.ParseCIDR("198.51.100.0/24")
+	g := &Greylist{
+		AllowSenders:  []string{"example.com", "jane@example.net"},
+		AllowNetworks: []*net.IPNet{network},
+	}
+
+	now := time.Now()
+	ip := net.ParseIP("192.0.2.1")
+
+	ok, _ := g.check(ip, "john@example.com", "a@example.org", now)
+	assert.True(t, ok)
+	ok, _ = g.check(ip, "jane@example.net", "a@example.org", now)
+	assert.True(t, ok)
+	ok, _ = g.check(net.ParseIP("198.51.100.7"), "john@example.net", "a@example.org", now)
+	assert.True(t, ok)
+	ok, _ = g.check(ip, "john@example.net", "a@example.org", now)
+	assert.False(t, ok)
+}
+
+func TestFileGreylistStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	store, err := OpenFileGreylistStore(path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Put("a", GreylistRecord{First: now, Last: now}))
+	assert.Nil(t, store.Put("b", GreylistRecord{First: now, Last: now}))
+	assert.Nil(t, store.Put("a", GreylistRecord{First: now, Last: now.Add(time.Hour), Passed: 1}))
+	assert.Nil(t, store.Close())
+
+	store, err = OpenFileGreylistStore(path)
+	assert.Nil(t, err)
+
+	record, ok, err := store.Get("a")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, GreylistRecord{First: now, Last: now.Add(time.Hour), Passed: 1}, record)
+
+	assert.Nil(t, store.Expire(now.Add(time.Minute)))
+	assert.Nil(t, store.Put("c", GreylistRecord{First: now, Last: now}))
+	assert.Nil(t, store.Close())
+
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, 2, bytes.Count(data, []byte("\n")))
+
+	store, err = OpenFileGreylistStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	_, ok, _ = store.Get("b")
+	assert.False(t, ok)
+	_, ok, _ = store.Get("c")
+	assert.True(t, ok)
+}
@@ -0,0 +1,149 @@
+package smtp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// checkHelo runs the checks configured for the name given in HELO or EHLO,
+// recording whether it is valid. It returns the reply to reject the command
+// with, or an empty string if it is accepted.
+func (s *Server) checkHelo(sess *session, name string) string {
+	if !s.CheckHelo && !s.StrictHelo {
+		return ""
+	}
+
+	if s.claimsServer(sess, name) {
+		sess.logger.Info("helo rejected", slog.String("name", name))
+		return rHELO_FORGED
+	}
+
+	sess.heloValid = validHelo(name)
+	if !sess.heloValid {
+		sess.logger.Info("invalid helo", slog.String("name", name))
+
+		if s.StrictHelo {
+			return rHELO_INVALID
+		}
+	}
+
+	return ""
+}
+
+// claimsServer reports whether name is the Server's own name, or the address
+// the client connected to when that is not also the client's address.
+func (s *Server) claimsServer(sess *session, name string) bool {
+	if strings.EqualFold(strings.TrimSuffix(name, "."), s.name) {
+		return true
+	}
+
+	ip := heloIP(name)
+	if ip == nil {
+		return false
+	}
+
+	local := addrIP(sess.localAddr)
+	return local != nil && ip.Equal(local) && !ip.Equal(sess.remoteIP())
+}
+
+// validHelo reports whether name is a fully qualified domain name or an address
+// literal, as required by RFC 5321 section 4.1.1.1.
+func validHelo(name string) bool {
+	if strings.HasPrefix(name, "[") {
+		return heloIP(name) != nil
+	}
+
+	return validHostname(name)
+}
+
+// heloIP returns the address given by an address literal, or a bare address,
+// in a HELO name.
+func heloIP(name string) net.IP {
+	if !strings.HasPrefix(name, "[") || !strings.HasSuffix(name, "]") {
+		return net.ParseIP(name)
+	}
+
+	literal := name[1 : len(name)-1]
+	if v6, ok := strings.CutPrefix(literal, "IPv6:"); ok {
+		if ip := net.ParseIP(v6); ip != nil && ip.To4() == nil {
+			return ip
+		}
+		return nil
+	}
+
+	if ip := net.ParseIP(literal); ip != nil && ip.To4() != nil {
+		return ip
+	}
+	return nil
+}
+
+// validHostname reports whether name is a fully qualified domain name made of
+// letters, digits and hyphens, with a top-level label that is not numeric.
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if !validDomain(name) {
+		return false
+	}
+
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return strings.Trim(labels[len(labels)-1], "0123456789") != ""
+}
+
+// checkFCrDNS returns the reverse DNS name of the client that resolves back to
+// its address, or an empty string if it has none.
+func (s *Server) checkFCrDNS(sess *session) string {
+	ip := sess.remoteIP()
+	if ip == nil {
+		return ""
+	}
+
+	ctx, cancel := context.WithTimeout(sess.ctx, lookupTimeout)
+	defer cancel()
+
+	resolver := s.resolver()
+
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		if !isNotFound(err) {
+			sess.logger.Warn("fcrdns", slog.Any("err", err))
+		}
+		return ""
+	}
+
+	for i, name := range names {
+		if i == 10 {
+			break
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			if !isNotFound(err) {
+				sess.logger.Warn("fcrdns", slog.Any("err", err))
+			}
+			continue
+		}
+
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,32 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Hooks are called by the Server at each step of serving a connection, for
+// example to trace sessions. The context returned by OnConnect is passed to the
+// other hooks for that connection, and is available to Handlers from
+// Message.Context. Hooks may be called from multiple goroutines at once.
+type Hooks interface {
+	// OnConnect is called when a connection is accepted, before the greeting is
+	// sent.
+	OnConnect(ctx context.Context, sessionID string, remoteAddr net.Addr) context.Context
+
+	// OnCommand is called when a command is received from the client.
+	OnCommand(ctx context.Context, command, args string)
+
+	// OnReply is called for each line sent to the client, with the time since
+	// the command it replies to was received.
+	OnReply(ctx context.Context, line string, d time.Duration)
+
+	// OnMessage is called after the Handlers, or StreamHandler, have been run
+	// for a Message, with the time they took and any error that occurred.
+	OnMessage(ctx context.Context, msg Message, d time.Duration, err error)
+
+	// OnDisconnect is called when the connection is closed, with the time it
+	// was open for.
+	OnDisconnect(ctx context.Context, d time.Duration)
+}
@@ -0,0 +1,90 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+const defaultMaxHops = 100
+
+// maxHeaderSize limits how much of a streamed message is read when looking for
+// the end of the header section.
+const maxHeaderSize = 1 << 20
+
+// maxHops returns the number of hops after which a Message is rejected, or zero
+// if there is no limit.
+func (s *Server) maxHops() int {
+	switch {
+	case s.MaxHops < 0:
+		return 0
+	case s.MaxHops == 0:
+		return defaultMaxHops
+	default:
+		return s.MaxHops
+	}
+}
+
+// tooManyHops reports whether the header contains more Received and
+// Delivered-To fields than allowed.
+func (s *Server) tooManyHops(header []byte) bool {
+	max := s.maxHops()
+	return max > 0 && countHops(header) > max
+}
+
+// countHops counts the Received and Delivered-To fields in the header section
+// at the start of data, as each represents a hop the message has taken.
+func countHops(data []byte) int {
+	hops := 0
+
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break
+		}
+
+		if hasFieldName(line, "Received") || hasFieldName(line, "Delivered-To") {
+			hops++
+		}
+	}
+
+	return hops
+}
+
+func hasFieldName(line []byte, name string) bool {
+	return len(line) > len(name) &&
+		line[len(name)] == ':' &&
+		bytes.EqualFold(line[:len(name)], []byte(name))
+}
+
+// readHeader reads the header section from r. It returns the header, and a
+// reader that returns the whole of r including the header.
+func readHeader(r io.Reader) ([]byte, io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	var header bytes.Buffer
+	for header.Len() < maxHeaderSize {
+		line, err := br.ReadBytes('\n')
+		header.Write(line)
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+
+	return header.Bytes(), io.MultiReader(bytes.NewReader(header.Bytes()), br), nil
+}
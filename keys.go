@@ -0,0 +1,184 @@
+package smtp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A SigningKey is a private key used to sign messages, with the selector its
+// public key is published under.
+type SigningKey struct {
+	Selector string
+
+	// Key is an *rsa.PrivateKey or an ed25519.PrivateKey.
+	Key crypto.Signer
+}
+
+// A KeyStore finds the key to sign messages for a domain with.
+type KeyStore interface {
+	SigningKey(ctx context.Context, domain string) (SigningKey, error)
+}
+
+// KeyMap is a KeyStore holding a key for each domain.
+type KeyMap map[string]SigningKey
+
+func (m KeyMap) SigningKey(ctx context.Context, domain string) (SigningKey, error) {
+	key, ok := m[strings.ToLower(domain)]
+	if !ok {
+		return SigningKey{}, fmt.Errorf("smtp: no signing key for %s", domain)
+	}
+
+	return key, nil
+}
+
+// ParseSigningKey parses a PEM encoded RSA or Ed25519 private key, in PKCS #8
+// or, for RSA, PKCS #1 form.
+func ParseSigningKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("smtp: no PEM data found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("smtp: unsupported signing key %T", key)
+		}
+
+	default:
+		return nil, fmt.Errorf("smtp: unsupported PEM block %q", block.Type)
+	}
+}
+
+// algorithm returns the signing algorithm, as used in the a= tag, for the key.
+func (k SigningKey) algorithm() (string, error) {
+	if k.Key == nil {
+		return "", errors.New("smtp: no signing key")
+	}
+
+	switch pub := k.Key.Public().(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 1024 {
+			return "", errors.New("smtp: rsa signing key too short")
+		}
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("smtp: unsupported signing key %T", pub)
+	}
+}
+
+// sign signs a SHA-256 hash with the key. Ed25519 keys sign the hash itself,
+// as described in RFC 8463.
+func (k SigningKey) sign(hashed []byte) ([]byte, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := k.Key.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+
+	return k.Key.Sign(rand.Reader, hashed, opts)
+}
+
+// signField returns a signature field named name, with tags followed by a b=
+// tag holding the signature of the hash returned for the unsigned field. Lines
+// end with CRLF.
+func signField(key SigningKey, name string, tags []string, hash func(headerField) []byte) (headerField, error) {
+	unsigned := strings.TrimSuffix(foldTags(name, tags), "\r\n") + ";\r\n\tb=\r\n"
+
+	signature, err := key.sign(hash(headerField(unsigned)))
+	if err != nil {
+		return "", err
+	}
+
+	b := base64.StdEncoding.EncodeToString(signature)
+	var folded strings.Builder
+	for len(b) > 72 {
+		folded.WriteString(b[:72] + "\r\n\t ")
+		b = b[72:]
+	}
+	folded.WriteString(b)
+
+	return headerField(strings.TrimSuffix(unsigned, "\r\n") + folded.String() + "\r\n"), nil
+}
+
+// foldTags formats a field of tags, folding lines before they become longer
+// than 78 characters where possible.
+func foldTags(name string, tags []string) string {
+	var b strings.Builder
+	b.WriteString(name + ":")
+	width := len(name) + 1
+
+	for i, tag := range tags {
+		if i < len(tags)-1 {
+			tag += ";"
+		}
+
+		if width+1+len(tag) > 78 && width > len(name)+1 {
+			b.WriteString("\r\n\t")
+			width = 1
+		} else {
+			b.WriteString(" ")
+			width++
+		}
+
+		b.WriteString(tag)
+		width += len(tag)
+	}
+
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// defaultSignedHeaders lists the fields signed when no list is given.
+var defaultSignedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// presentFields returns the names that appear in fields, repeated for each
+// instance of the field. Names given again are kept, so that the signature
+// also covers fields being added.
+func presentFields(fields []headerField, names []string) []string {
+	var present []string
+	seen := map[string]bool{}
+
+	for _, name := range names {
+		if seen[strings.ToLower(name)] {
+			present = append(present, name)
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+
+		for _, field := range fields {
+			if strings.EqualFold(field.name(), name) {
+				present = append(present, name)
+			}
+		}
+	}
+
+	return present
+}
@@ -0,0 +1,233 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// commandNames are the commands counted individually, any other command is
+// counted as "unknown" so that clients cannot create unbounded series.
+var commandNames = []string{
+	"AUTH", "DATA", "EHLO", "EXPN", "HELO", "HELP", "MAIL",
+	"NOOP", "QUIT", "RCPT", "RSET", "VRFY", "unknown",
+}
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects counts of the activity of a Server. It implements
+// http.Handler, serving the values in the Prometheus text exposition format.
+// A nil *Metrics collects nothing.
+type Metrics struct {
+	connections       uint64
+	activeConnections int64
+	commands          map[string]*uint64
+	messagesAccepted  uint64
+	messagesRejected  uint64
+	bytesReceived     uint64
+	authSuccesses     uint64
+	authFailures      uint64
+
+	sessionDuration *histogram
+	handlerDuration *histogram
+}
+
+// NewMetrics creates an empty Metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		commands:        map[string]*uint64{},
+		sessionDuration: newHistogram([]float64{.1, .5, 1, 5, 10, 30, 60, 300}),
+		handlerDuration: newHistogram(defaultBuckets),
+	}
+
+	for _, name := range commandNames {
+		m.commands[name] = new(uint64)
+	}
+
+	return m
+}
+
+func (m *Metrics) connectionOpened() {
+	if m == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.connections, 1)
+	atomic.AddInt64(&m.activeConnections, 1)
+}
+
+func (m *Metrics) connectionClosed(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	atomic.AddInt64(&m.activeConnections, -1)
+	m.sessionDuration.observe(d.Seconds())
+}
+
+func (m *Metrics) command(name string) {
+	if m == nil {
+		return
+	}
+
+	counter, ok := m.commands[name]
+	if !ok {
+		counter = m.commands["unknown"]
+	}
+	atomic.AddUint64(counter, 1)
+}
+
+func (m *Metrics) message(accepted bool, size int64) {
+	if m == nil {
+		return
+	}
+
+	atomic.AddUint64(&m.bytesReceived, uint64(size))
+	if accepted {
+		atomic.AddUint64(&m.messagesAccepted, 1)
+	} else {
+		atomic.AddUint64(&m.messagesRejected, 1)
+	}
+}
+
+func (m *Metrics) auth(ok bool) {
+	if m == nil {
+		return
+	}
+
+	if ok {
+		atomic.AddUint64(&m.authSuccesses, 1)
+	} else {
+		atomic.AddUint64(&m.authFailures, 1)
+	}
+}
+
+func (m *Metrics) handler(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.handlerDuration.observe(d.Seconds())
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the current values in the Prometheus text exposition format.
+// A nil *Metrics writes nothing.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+
+	cw := &countingWriter{w: w}
+
+	writeHeader(cw, "smtp_connections_total", "counter", "Total number of connections accepted.")
+	fmt.Fprintf(cw, "smtp_connections_total %d\n", atomic.LoadUint64(&m.connections))
+
+	writeHeader(cw, "smtp_connections_active", "gauge", "Number of connections currently open.")
+	fmt.Fprintf(cw, "smtp_connections_active %d\n", atomic.LoadInt64(&m.activeConnections))
+
+	writeHeader(cw, "smtp_commands_total", "counter", "Total number of commands received.")
+	names := make([]string, 0, len(m.commands))
+	for name := range m.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(cw, "smtp_commands_total{command=%q} %d\n", name, atomic.LoadUint64(m.commands[name]))
+	}
+
+	writeHeader(cw, "smtp_messages_total", "counter", "Total number of messages received, by result.")
+	fmt.Fprintf(cw, "smtp_messages_total{result=\"accepted\"} %d\n", atomic.LoadUint64(&m.messagesAccepted))
+	fmt.Fprintf(cw, "smtp_messages_total{result=\"rejected\"} %d\n", atomic.LoadUint64(&m.messagesRejected))
+
+	writeHeader(cw, "smtp_received_bytes_total", "counter", "Total number of message bytes received.")
+	fmt.Fprintf(cw, "smtp_received_bytes_total %d\n", atomic.LoadUint64(&m.bytesReceived))
+
+	writeHeader(cw, "smtp_auth_total", "counter", "Total number of authentication attempts, by result.")
+	fmt.Fprintf(cw, "smtp_auth_total{result=\"success\"} %d\n", atomic.LoadUint64(&m.authSuccesses))
+	fmt.Fprintf(cw, "smtp_auth_total{result=\"failure\"} %d\n", atomic.LoadUint64(&m.authFailures))
+
+	writeHeader(cw, "smtp_session_duration_seconds", "histogram", "Duration of client connections.")
+	m.sessionDuration.writeTo(cw, "smtp_session_duration_seconds")
+
+	writeHeader(cw, "smtp_handler_duration_seconds", "histogram", "Time taken to run handlers for a message.")
+	m.handlerDuration.writeTo(cw, "smtp_handler_duration_seconds")
+
+	return cw.n, cw.err
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(upper), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
@@ -0,0 +1,243 @@
+package smtp
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// Session describes the client connection that a command was received on.
+type Session struct {
+	ID         string
+	RemoteAddr net.Addr
+
+	// Helo is the name given by the client in HELO or EHLO. If the Server
+	// checks it, HeloValid reports whether it is a valid name.
+	Helo      string
+	HeloValid bool
+
+	// HeloSPF is the result of evaluating the SPF policy of Helo, if the Server
+	// verifies SPF and Helo is a fully qualified domain name. It is evaluated
+	// when the client gives a sender other than the null sender, whose result
+	// is itself that of Helo.
+	HeloSPF SPFResult
+
+	// ReverseName is the client's forward-confirmed reverse DNS name, if the
+	// Server checks it, or empty if it has none.
+	ReverseName string
+
+	// User is the name the client authenticated as, or empty.
+	User string
+
+	// Trusted reports whether the client is in a network trusted by the
+	// Server's AccessPolicy.
+	Trusted bool
+
+	// Listings holds the Blocklists that the client, or the domain of the
+	// current sender, is listed on; and Score is the total of their scores.
+	Listings []Listing
+	Score    int
+}
+
+// A SenderPolicy decides whether to accept mail from sender, the address given
+// in a MAIL command. If the Server verifies SPF the result is given, otherwise
+// it is empty. Returning an error rejects the sender; if the error is a *Reply
+// it is sent to the client, otherwise a 550 reply is sent.
+type SenderPolicy func(sess Session, sender string, spf SPFResult) error
+
+// CheckSender registers the SenderPolicy to be used when a MAIL command is
+// issued to the Server. If a SenderPolicy was previously registered it is
+// overwritten.
+func (s *Server) CheckSender(policy SenderPolicy) {
+	s.senderPolicy = policy
+}
+
+// info describes the session to a policy checking a sender with the
+// senderListings given.
+func (sess *session) info(senderListings []Listing) Session {
+	info := Session{
+		ID:          sess.id,
+		RemoteAddr:  sess.remoteAddr,
+		Helo:        sess.helo,
+		HeloValid:   sess.heloValid,
+		HeloSPF:     sess.heloSPF.result,
+		ReverseName: sess.fcrdns,
+		User:        sess.user,
+		Trusted:     sess.trusted,
+	}
+
+	for _, listings := range [][]Listing{sess.listings, senderListings} {
+		for _, listing := range listings {
+			info.Listings = append(info.Listings, listing)
+			info.Score += listing.Score
+		}
+	}
+
+	return info
+}
+
+// checkClient runs the checks configured for a new connection, returning the
+// reply to refuse it with or an empty string if it is accepted.
+func (s *Server) checkClient(sess *session) string {
+	if ip := sess.remoteIP(); ip != nil && len(s.Blocklists) > 0 {
+		sess.listings = s.checkBlocklists(sess, false, ip, ip.String())
+
+		if rejected(sess.listings) {
+			if s.BlocklistReply != "" {
+				return s.BlocklistReply
+			}
+			return rBLOCKLISTED
+		}
+	}
+
+	if s.VerifyFCrDNS || s.RequireFCrDNS {
+		sess.fcrdns = s.checkFCrDNS(sess)
+
+		if sess.fcrdns != "" {
+			sess.rdns, sess.rdnsDone = sess.fcrdns, true
+		} else if s.RequireFCrDNS {
+			sess.logger.Info("no forward-confirmed reverse dns")
+			return rNO_FCRDNS
+		}
+	}
+
+	return ""
+}
+
+// refuse sends reply in place of the greeting, then answers every command with
+// 503 until the client quits, as described in RFC 5321 section 3.1.
+func refuse(text connection, reply string) {
+	text.write("%s", reply)
+
+	for {
+		cmd, _, err := text.read()
+		if err != nil {
+			return
+		}
+
+		if strings.ToUpper(cmd) == "QUIT" {
+			text.write(rBYE)
+			return
+		}
+
+		text.write(rOUT_OF_SEQUENCE)
+	}
+}
+
+func rejected(listings []Listing) bool {
+	for _, listing := range listings {
+		if listing.Reject {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSender runs the checks configured for a MAIL command, returning the
+// reply to reject the sender with or an empty string if it is accepted.
+func (s *Server) checkSender(sess *session, sender string) string {
+	// The session is only changed once the sender is accepted, as a rejected
+	// sender leaves the transaction as it was.
+	var spf spfCheck
+	if s.VerifySPF {
+		spf = s.checkSPF(sess, sender)
+
+		if sender != "" {
+			s.checkHeloSPF(sess)
+		}
+	}
+
+	var listings []Listing
+	if _, domain := splitAddress(sender); sender != "" && len(s.Blocklists) > 0 {
+		listings = s.checkBlocklists(sess, true, nil, domain)
+
+		if rejected(listings) {
+			return rSENDER_BLOCKLISTED
+		}
+	}
+
+	if s.senderPolicy != nil {
+		if err := s.senderPolicy(sess.info(listings), sender, spf.result); err != nil {
+			sess.logger.Info("sender rejected", slog.String("sender", sender), slog.Any("err", err))
+			return replyFor(err, rSENDER_REJECTED)
+		}
+	}
+
+	sess.sender = sender
+	sess.spf = spf
+	sess.senderListings = listings
+	return ""
+}
+
+// checkRecipient runs the checks configured for a RCPT command, returning the
+// reply to reject the recipient with or an empty string if it is accepted.
+func (s *Server) checkRecipient(sess *session, recipient string) string {
+	if s.isPostmaster(recipient) {
+		return ""
+	}
+
+	if reply := s.checkRelay(sess, recipient); reply != "" {
+		return reply
+	}
+
+	if s.Greylist != nil && sess.user == "" {
+		if ip := sess.remoteIP(); ip != nil {
+			ok, err := s.Greylist.check(ip, sess.sender, recipient, time.Now())
+			if err != nil {
+				sess.logger.Error("greylist", slog.Any("err", err))
+			}
+			if !ok {
+				sess.logger.Info("greylisted", slog.String("sender", sess.sender), slog.String("recipient", recipient))
+				return rGREYLISTED
+			}
+		}
+	}
+
+	return ""
+}
+
+// spfCheck records the result of checking SPF for a transaction.
+type spfCheck struct {
+	result   SPFResult
+	identity string
+	sender   string
+	domain   string
+}
+
+func (s *Server) checkSPF(sess *session, sender string) spfCheck {
+	check := spfCheck{identity: "mailfrom", sender: sender}
+	if sender == "" {
+		check.identity = "helo"
+		check.domain = sess.helo
+	} else {
+		_, check.domain = splitAddress(sender)
+	}
+
+	ctx, cancel := context.WithTimeout(sess.ctx, lookupTimeout)
+	defer cancel()
+
+	result, err := CheckSPF(ctx, s.resolver(), sess.remoteIP(), sess.helo, sender)
+	if err != nil {
+		sess.logger.Info("spf", slog.String("result", string(result)), slog.Any("err", err))
+	}
+	check.result = result
+
+	return check
+}
+
+// checkHeloSPF evaluates the SPF policy of the HELO name separately from the
+// sender's, as recommended by RFC 7208 section 2.3, if it is a fully qualified
+// domain name. As it depends only on the name the result is kept for the
+// session until the client gives another.
+func (s *Server) checkHeloSPF(sess *session) {
+	if sess.heloSPF.identity != "" {
+		return
+	}
+
+	sess.heloSPF = spfCheck{identity: "helo", domain: sess.helo}
+	if validHostname(sess.helo) {
+		sess.heloSPF = s.checkSPF(sess, "")
+	}
+}
@@ -0,0 +1,38 @@
+package smtp
+
+import "strings"
+
+// isPostmaster reports whether addr is the postmaster, or one of the
+// RoleMailboxes, of the Server: either the bare "postmaster", or at the
+// Server's name or one of its LocalDomains.
+func (s *Server) isPostmaster(addr string) bool {
+	if !strings.Contains(addr, "@") {
+		return strings.EqualFold(addr, "postmaster")
+	}
+
+	local, domain := splitAddress(addr)
+	if !strings.EqualFold(local, "postmaster") && !containsFold(s.RoleMailboxes, local) {
+		return false
+	}
+
+	return strings.EqualFold(strings.TrimSuffix(domain, "."), s.name) ||
+		len(s.LocalDomains) > 0 && s.isLocal(addr)
+}
+
+// routePostmaster splits recipients into those for the Postmaster Handler and
+// the rest. If there is no Postmaster Handler all are returned as the rest.
+func (s *Server) routePostmaster(recipients []string) (postmaster, rest []string) {
+	if s.Postmaster == nil {
+		return nil, recipients
+	}
+
+	for _, recipient := range recipients {
+		if s.isPostmaster(recipient) {
+			postmaster = append(postmaster, recipient)
+		} else {
+			rest = append(rest, recipient)
+		}
+	}
+
+	return postmaster, rest
+}
@@ -0,0 +1,38 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPostmaster(t *testing.T) {
+	s := &Server{name: "mx.example.org", RoleMailboxes: []string{"abuse"}}
+
+	assert.True(t, s.isPostmaster("postmaster"))
+	assert.True(t, s.isPostmaster("PostMaster"))
+	assert.True(t, s.isPostmaster("postmaster@mx.example.org"))
+	assert.True(t, s.isPostmaster("abuse@MX.example.org."))
+	assert.False(t, s.isPostmaster("abuse"))
+	assert.False(t, s.isPostmaster("postmaster@example.org"))
+	assert.False(t, s.isPostmaster("john.doe@mx.example.org"))
+
+	s.LocalDomains = []string{"example.org"}
+	assert.True(t, s.isPostmaster("postmaster@example.org"))
+	assert.True(t, s.isPostmaster("abuse@example.org"))
+	assert.False(t, s.isPostmaster("postmaster@example.net"))
+}
+
+func TestRoutePostmaster(t *testing.T) {
+	s := &Server{name: "mx.example.org"}
+
+	postmaster, rest := s.routePostmaster([]string{"postmaster", "john.doe@example.org"})
+	assert.Nil(t, postmaster)
+	assert.Equal(t, []string{"postmaster", "john.doe@example.org"}, rest)
+
+	s.Postmaster = func(Message) {}
+
+	postmaster, rest = s.routePostmaster([]string{"postmaster", "john.doe@example.org", "postmaster@mx.example.org"})
+	assert.Equal(t, []string{"postmaster", "postmaster@mx.example.org"}, postmaster)
+	assert.Equal(t, []string{"john.doe@example.org"}, rest)
+}
@@ -0,0 +1,206 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxySignature starts a version 2 PROXY protocol header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection received through a proxy, with the addresses given
+// in its PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+// fromProxy reports whether addr is in one of the ProxyNetworks.
+func (s *Server) fromProxy(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range s.ProxyNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveProxied reads the PROXY protocol header from a connection accepted from
+// a trusted proxy, then serves it as though it came from the client given.
+func (s *Server) serveProxied(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+
+	pconn, err := readProxyHeader(conn)
+	if err != nil {
+		s.logger().Warn("proxy",
+			slog.String("remote", conn.RemoteAddr().String()),
+			slog.Any("err", err))
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	rule := s.Access.match(addrIP(pconn.RemoteAddr()))
+	if rule.Action == AccessDeny {
+		s.deny(pconn, rule)
+		return
+	}
+
+	s.serve(pconn, rule.Action == AccessTrust)
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header from conn. If
+// the header does not give the client's address, as for health checks, the
+// connection's own addresses are kept.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	pconn := &proxyConn{
+		Conn:   conn,
+		r:      bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	if sig, err := pconn.r.Peek(len(proxySignature)); err == nil && bytes.Equal(sig, proxySignature) {
+		return pconn, readProxyV2(pconn)
+	}
+
+	return pconn, readProxyV1(pconn)
+}
+
+// readProxyV1 reads a header in the form
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n
+func readProxyV1(pconn *proxyConn) error {
+	// The longest header is 107 bytes, including the CRLF.
+	line, err := pconn.r.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return err
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("proxy: invalid v1 header")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return errors.New("proxy: invalid v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("proxy: unknown protocol %q", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return errors.New("proxy: invalid v1 header")
+	}
+
+	remote, err := proxyAddr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return err
+	}
+	local, err := proxyAddr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return err
+	}
+
+	pconn.remote, pconn.local = remote, local
+	return nil
+}
+
+func proxyAddr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") == v4 {
+		return nil, fmt.Errorf("proxy: invalid address %q", host)
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("proxy: invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+// readProxyV2 reads a binary header, see section 2.2 of the PROXY protocol
+// specification.
+func readProxyV2(pconn *proxyConn) error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(pconn.r, header); err != nil {
+		return err
+	}
+
+	if version := header[12] >> 4; version != 2 {
+		return fmt.Errorf("proxy: unknown version %d", version)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(pconn.r, body); err != nil {
+		return err
+	}
+
+	switch command := header[12] & 0xf; command {
+	case 0x0:
+		// LOCAL, sent by the proxy itself.
+		return nil
+	case 0x1:
+		// PROXY
+	default:
+		return fmt.Errorf("proxy: unknown command %d", command)
+	}
+
+	var size int
+	switch family := header[13] >> 4; family {
+	case 0x1:
+		size = net.IPv4len
+	case 0x2:
+		size = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX, neither of which give a usable address.
+		return nil
+	}
+
+	if header[13]&0xf != 0x1 {
+		// Only STREAM is meaningful for SMTP.
+		return errors.New("proxy: unsupported transport")
+	}
+
+	if len(body) < 2*size+4 {
+		return errors.New("proxy: address block too short")
+	}
+
+	pconn.remote = &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	pconn.local = &net.TCPAddr{
+		IP:   net.IP(body[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+	return nil
+}
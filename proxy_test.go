@@ -0,0 +1,95 @@
+package smtp
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readProxyTest(t *testing.T, header string) (*proxyConn, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go client.Write([]byte(header + "EHLO local.test\r\n"))
+
+	pconn, err := readProxyHeader(server)
+	if err != nil {
+		return nil, err
+	}
+
+	line, err := bufio.NewReader(pconn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "EHLO local.test\r\n", line)
+
+	return pconn, nil
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	pconn, err := readProxyTest(t, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "192.0.2.1:56324", pconn.RemoteAddr().String())
+		assert.Equal(t, "198.51.100.1:25", pconn.LocalAddr().String())
+	}
+
+	pconn, err = readProxyTest(t, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "[2001:db8::1]:56324", pconn.RemoteAddr().String())
+		assert.Equal(t, "[2001:db8::2]:25", pconn.LocalAddr().String())
+	}
+
+	pconn, err = readProxyTest(t, "PROXY UNKNOWN\r\n")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "pipe", pconn.RemoteAddr().String())
+	}
+
+	for _, invalid := range []string{
+		"",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 25\r\n",
+		"PROXY TCP6 192.0.2.1 198.51.100.1 56324 25\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 56324 25\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n",
+	} {
+		_, err := readProxyTest(t, invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	const signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+	pconn, err := readProxyTest(t, signature+"\x21\x11\x00\x0c"+
+		"\xc0\x00\x02\x01"+"\xc6\x33\x64\x01"+"\xdc\x04"+"\x00\x19")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "192.0.2.1:56324", pconn.RemoteAddr().String())
+		assert.Equal(t, "198.51.100.1:25", pconn.LocalAddr().String())
+	}
+
+	pconn, err = readProxyTest(t, signature+"\x21\x21\x00\x2a"+
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"+
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02"+
+		"\xdc\x04"+"\x00\x19"+
+		"\x04\x00\x03abc")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "[2001:db8::1]:56324", pconn.RemoteAddr().String())
+		assert.Equal(t, "[2001:db8::2]:25", pconn.LocalAddr().String())
+	}
+
+	pconn, err = readProxyTest(t, signature+"\x20\x00\x00\x00")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "pipe", pconn.RemoteAddr().String())
+	}
+
+	for _, invalid := range []string{
+		signature + "\x11\x11\x00\x0c" + "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19",
+		signature + "\x22\x11\x00\x0c" + "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19",
+		signature + "\x21\x12\x00\x0c" + "\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x00\x19",
+		signature + "\x21\x11\x00\x08" + "\xc0\x00\x02\x01\xc6\x33\x64\x01",
+	} {
+		_, err := readProxyTest(t, invalid)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,95 @@
+package smtp
+
+import (
+	_ "embed"
+	"strings"
+	"sync"
+)
+
+// publicSuffixList is the list from https://publicsuffix.org/list/, used to
+// find the organizational domain of a name.
+//
+//go:embed public_suffix_list.dat
+var publicSuffixList string
+
+// suffixRule records the kinds of rule given for a name, as a name may have
+// both a normal rule and a wildcard rule.
+type suffixRule int
+
+const (
+	suffixNormal suffixRule = 1 << iota
+	suffixWildcard
+	suffixException
+)
+
+var (
+	suffixRulesOnce sync.Once
+	suffixRules     map[string]suffixRule
+)
+
+func loadSuffixRules() {
+	suffixRules = map[string]suffixRule{}
+
+	for _, line := range strings.Split(publicSuffixList, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ToLower(line)
+
+		switch {
+		case strings.HasPrefix(line, "!"):
+			suffixRules[line[1:]] |= suffixException
+		case strings.HasPrefix(line, "*."):
+			suffixRules[line[2:]] |= suffixWildcard
+		default:
+			suffixRules[line] |= suffixNormal
+		}
+	}
+}
+
+// publicSuffix returns the public suffix of domain, using the algorithm given
+// at https://publicsuffix.org/list/. If no rule matches, the last label is the
+// suffix.
+func publicSuffix(domain string) string {
+	suffixRulesOnce.Do(loadSuffixRules)
+
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+
+		if suffixRules[name]&suffixException != 0 {
+			return strings.Join(labels[i+1:], ".")
+		}
+		if suffixRules[name]&suffixNormal != 0 {
+			return name
+		}
+		if i+1 < len(labels) && suffixRules[strings.Join(labels[i+1:], ".")]&suffixWildcard != 0 {
+			return name
+		}
+	}
+
+	return labels[len(labels)-1]
+}
+
+// organizationalDomain returns the organizational domain of domain, as
+// described in RFC 7489 section 3.2: the public suffix with one more label.
+func organizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	suffix := publicSuffix(domain)
+
+	if domain == suffix {
+		return domain
+	}
+
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	if i := strings.LastIndex(rest, "."); i >= 0 {
+		rest = rest[i+1:]
+	}
+
+	return rest + "." + suffix
+}
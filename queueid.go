@@ -0,0 +1,43 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+var queueIDEncoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+var queueIDs struct {
+	sync.Mutex
+	last uint64
+}
+
+// NewQueueID returns a new unique identifier for a Message. It is the default
+// used by a Server. Identifiers are 16 characters long and sort in the order they
+// were created.
+func NewQueueID() string {
+	queueIDs.Lock()
+	now := uint64(time.Now().UnixMicro())
+	if now <= queueIDs.last {
+		now = queueIDs.last + 1
+	}
+	queueIDs.last = now
+	queueIDs.Unlock()
+
+	b := make([]byte, 10)
+	binary.BigEndian.PutUint64(b, now)
+	rand.Read(b[8:])
+
+	return queueIDEncoding.EncodeToString(b)
+}
+
+func (s *Server) newQueueID() string {
+	if s.QueueID != nil {
+		return s.QueueID()
+	}
+
+	return NewQueueID()
+}
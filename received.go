@@ -0,0 +1,366 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// traceHeaders returns the Return-Path, Received-SPF, Authentication-Results
+// and Received headers to prepend to msg, as configured, using eol to end each
+// line.
+func (s *Server) traceHeaders(sess *session, msg Message, now time.Time, eol string) []byte {
+	var buf bytes.Buffer
+
+	if s.AddReturnPath {
+		fmt.Fprintf(&buf, "Return-Path: <%s>%s", msg.Sender, eol)
+	}
+
+	for _, spf := range sess.spfChecks() {
+		buf.WriteString(s.receivedSPF(sess, spf, msg.Sender, eol))
+	}
+
+	if s.addsAuthenticationResults() {
+		buf.WriteString(s.authenticationResults(sess, msg, eol))
+	}
+
+	if s.AddReceived {
+		buf.WriteString(s.received(sess, msg, now, eol))
+	}
+
+	return buf.Bytes()
+}
+
+// received formats a Received header as described in RFC 5321 section 4.4.
+func (s *Server) received(sess *session, msg Message, now time.Time, eol string) string {
+	// The name given in HELO is not checked unless CheckHelo is set, so must
+	// be quoted if it is not a domain or address literal.
+	helo := sess.helo
+	if !isDotAtom(helo) && heloIP(helo) == nil {
+		helo = quoteString(helo)
+	}
+
+	from := "from " + helo
+	if sess.helo == "" {
+		from = "from unknown"
+	}
+
+	if ip := sess.remoteIP(); ip != nil {
+		literal := "[" + ip.String() + "]"
+		if ip.To4() == nil {
+			literal = "[IPv6:" + ip.String() + "]"
+		}
+
+		if name := sess.reverseName(s.resolver()); name != "" {
+			from += " (" + name + " " + literal + ")"
+		} else {
+			from += " (" + literal + ")"
+		}
+	}
+
+	by := "by " + s.name + " with " + sess.protocol()
+	if msg.ID != "" {
+		by += " id " + msg.ID
+	}
+
+	clauses := []string{from, by}
+	if len(msg.Recipients) == 1 {
+		clauses = append(clauses, "for <"+msg.Recipients[0]+">")
+	}
+	clauses[len(clauses)-1] += "; " + now.Format(time.RFC1123Z)
+
+	return "Received: " + strings.Join(clauses, eol+"\t") + eol
+}
+
+// protocol returns the protocol type, from RFC 3848, for the session.
+func (sess *session) protocol() string {
+	if !sess.extended {
+		return "SMTP"
+	}
+
+	protocol := "ESMTP"
+	if sess.tls {
+		protocol += "S"
+	}
+	if sess.user != "" {
+		protocol += "A"
+	}
+
+	return protocol
+}
+
+func (sess *session) remoteIP() net.IP {
+	return addrIP(sess.remoteAddr)
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// reverseName returns the name the remote address resolves to, or an empty
+// string if it does not. The result is cached for the session.
+func (sess *session) reverseName(resolver Resolver) string {
+	if sess.rdnsDone {
+		return sess.rdns
+	}
+	sess.rdnsDone = true
+
+	ip := sess.remoteIP()
+	if ip == nil {
+		return ""
+	}
+
+	names, err := resolver.LookupAddr(sess.ctx, ip.String())
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+
+	sess.rdns = strings.TrimSuffix(names[0], ".")
+	return sess.rdns
+}
+
+// spfChecks returns the SPF checks made for the transaction: of the sender,
+// and of the HELO name if it was checked separately.
+func (sess *session) spfChecks() []spfCheck {
+	if sess.spf.result == "" {
+		return nil
+	}
+	if sess.spf.identity == "helo" || sess.heloSPF.result == "" {
+		return []spfCheck{sess.spf}
+	}
+
+	return []spfCheck{sess.spf, sess.heloSPF}
+}
+
+// receivedSPF formats a Received-SPF header as described in RFC 7208 section
+// 9.1, for a check made for a message from sender.
+func (s *Server) receivedSPF(sess *session, spf spfCheck, sender string, eol string) string {
+
+	ip := ""
+	if remoteIP := sess.remoteIP(); remoteIP != nil {
+		ip = remoteIP.String()
+	}
+
+	who := "domain of " + spf.sender
+	if spf.identity == "helo" {
+		who = "domain of " + spf.domain
+	}
+
+	var comment string
+	switch spf.result {
+	case SPFPass:
+		comment = who + " designates " + ip + " as permitted sender"
+	case SPFFail:
+		comment = who + " does not designate " + ip + " as permitted sender"
+	case SPFSoftFail:
+		comment = "transitioning " + who + " does not designate " + ip + " as permitted sender"
+	case SPFNeutral:
+		comment = ip + " is neither permitted nor denied by " + who
+	case SPFNone:
+		comment = who + " does not designate permitted sender hosts"
+	case SPFTempError:
+		comment = "temporary error evaluating policy of " + spf.domain
+	case SPFPermError:
+		comment = "permanent error evaluating policy of " + spf.domain
+	}
+
+	helo := sess.helo
+	if !isDotAtom(helo) {
+		helo = quoteString(helo)
+	}
+
+	return fmt.Sprintf("Received-SPF: %s (%s: %s)%s\tclient-ip=%s; envelope-from=%s; helo=%s;%s\tidentity=%s; receiver=%s;%s",
+		spf.result, s.name, escapeComment(comment), eol,
+		ip, quoteString(sender), helo, eol,
+		spf.identity, s.name, eol)
+}
+
+// authenticationResults formats an Authentication-Results header as described
+// in RFC 8601, for the checks recorded in msg.
+func (s *Server) authenticationResults(sess *session, msg Message, eol string) string {
+	var results []string
+
+	if msg.SPF != "" {
+		for _, spf := range sess.spfChecks() {
+			property := "smtp.mailfrom=" + pvalue(spf.sender)
+			if spf.identity == "helo" {
+				property = "smtp.helo=" + pvalue(sess.helo)
+			}
+			results = append(results, "spf="+string(spf.result)+" "+property)
+		}
+	}
+
+	if msg.DKIM != nil && len(msg.DKIM) == 0 {
+		results = append(results, "dkim=none")
+	}
+	for _, sig := range msg.DKIM {
+		result := "dkim=" + string(sig.Status) + " header.d=" + pvalue(sig.Domain) + " header.s=" + pvalue(sig.Selector)
+		if sig.Identifier != "" {
+			result += " header.i=" + pvalue(sig.Identifier)
+		}
+		results = append(results, result)
+	}
+
+	if msg.DMARC.Status != "" {
+		result := "dmarc=" + string(msg.DMARC.Status)
+		if msg.DMARC.Domain != "" {
+			result += " header.from=" + pvalue(msg.DMARC.Domain)
+		}
+		results = append(results, result)
+	}
+
+	if msg.ARC.Status != "" {
+		results = append(results, "arc="+string(msg.ARC.Status))
+	}
+
+	if len(results) == 0 {
+		return "Authentication-Results: " + s.name + "; none" + eol
+	}
+
+	return "Authentication-Results: " + s.name + ";" + eol + "\t" + strings.Join(results, ";"+eol+"\t") + eol
+}
+
+// addsAuthenticationResults reports whether an Authentication-Results header
+// is prepended to each Message.
+func (s *Server) addsAuthenticationResults() bool {
+	return s.VerifySPF || s.VerifyDKIM || s.VerifyDMARC || s.VerifyARC
+}
+
+// removeAuthenticationResults returns data without the Authentication-Results
+// fields in its header section that claim authservID, as RFC 8601 section 5
+// requires, so that they cannot be mistaken for the one the Server adds. If
+// there are none data is returned as it is.
+func removeAuthenticationResults(data []byte, authservID string) []byte {
+	var out []byte
+	removed, last := false, 0
+
+fields:
+	for start := 0; start < len(data); {
+		// A field continues onto the following lines that start with
+		// whitespace, and the header section ends at an empty line.
+		end := start
+		for end < len(data) {
+			next := len(data)
+			if i := bytes.IndexByte(data[end:], '\n'); i >= 0 {
+				next = end + i + 1
+			}
+
+			line := bytes.TrimRight(data[end:next], "\r\n")
+			if len(line) == 0 && end == start {
+				break fields
+			}
+			if end > start && (len(line) == 0 || line[0] != ' ' && line[0] != '\t') {
+				break
+			}
+			end = next
+		}
+
+		name, value, _ := strings.Cut(string(data[start:end]), ":")
+		if strings.EqualFold(strings.TrimRight(name, " \t"), "Authentication-Results") &&
+			strings.EqualFold(strings.TrimSuffix(authServID(value), "."), strings.TrimSuffix(authservID, ".")) {
+			out = append(out, data[last:start]...)
+			removed, last = true, end
+		}
+
+		start = end
+	}
+
+	if !removed {
+		return data
+	}
+
+	return append(out, data[last:]...)
+}
+
+// authServID returns the authserv-id given at the start of the value of an
+// Authentication-Results field, ignoring any comments.
+func authServID(value string) string {
+	var b strings.Builder
+	depth := 0
+
+loop:
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' && depth > 0:
+			i++
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == ';':
+			break loop
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	id := strings.Fields(b.String())
+	if len(id) == 0 {
+		return ""
+	}
+
+	return strings.Trim(id[0], `"`)
+}
+
+// escapeComment escapes the parentheses and backslashes in s, and removes
+// control characters, so that it can be given in a comment.
+func escapeComment(s string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		switch {
+		case r < ' ' || r == 0x7f:
+			continue
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// pvalue formats s as a property value in an Authentication-Results header, see
+// RFC 8601 section 2.2: an address or domain is given as it is, and anything
+// else as a quoted-string.
+func pvalue(s string) string {
+	if validAddress(s) || validAddressDomain(strings.TrimPrefix(s, "@")) {
+		return s
+	}
+
+	return quoteString(s)
+}
+
+// quoteString returns s as a quoted-string, escaping quotes and backslashes and
+// removing control characters.
+func quoteString(s string) string {
+	var b strings.Builder
+
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r < ' ' || r == 0x7f:
+			continue
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPvalue(t *testing.T) {
+	assert.Equal(t, "john.doe@example.com", pvalue("john.doe@example.com"))
+	assert.Equal(t, `"john doe"@example.com`, pvalue(`"john doe"@example.com`))
+	assert.Equal(t, "@example.com", pvalue("@example.com"))
+	assert.Equal(t, "example.com", pvalue("example.com"))
+	assert.Equal(t, `""`, pvalue(""))
+	assert.Equal(t, `"[192.0.2.1]"`, pvalue("[192.0.2.1]"))
+	assert.Equal(t, `"a@x.example; dkim=pass header.d=bank.example"`,
+		pvalue("a@x.example; dkim=pass header.d=bank.example"))
+	assert.Equal(t, `"a\"; dkim=pass \\"`, pvalue("a\"; dkim=pass \\\r\n"))
+}
+
+func TestReceivedSPFEscapesValues(t *testing.T) {
+	s := &Server{name: "mx.example.org"}
+	sess := &session{
+		helo: "[192.0.2.1]",
+		spf: spfCheck{
+			result:   SPFNone,
+			identity: "mailfrom",
+			sender:   `"a\"; x=(y)"@example.com`,
+			domain:   "example.com",
+		},
+	}
+
+	assert.Equal(t, `Received-SPF: none (mx.example.org: domain of "a\\"; x=\(y\)"@example.com does not designate permitted sender hosts)`+"\n"+
+		`	client-ip=; envelope-from="\"a\\\"; x=(y)\"@example.com"; helo="[192.0.2.1]";`+"\n"+
+		"\tidentity=mailfrom; receiver=mx.example.org;\n", s.receivedSPF(sess, sess.spf, sess.spf.sender, "\n"))
+}
+
+func TestReceivedQuotesHelo(t *testing.T) {
+	s := &Server{name: "mx.example.org"}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for helo, from := range map[string]string{
+		"local.test":                  "from local.test",
+		"[192.0.2.1]":                 "from [192.0.2.1]",
+		"my host":                     `from "my host"`,
+		"x; Mon, 1 Jan 2001 (by y.z)": `from "x; Mon, 1 Jan 2001 (by y.z)"`,
+	} {
+		sess := &session{helo: helo}
+		assert.Equal(t, "Received: "+from+"\n\tby mx.example.org with SMTP; Thu, 02 Jan 2020 03:04:05 +0000\n",
+			s.received(sess, Message{}, now, "\n"), helo)
+	}
+}
+
+func TestRemoveAuthenticationResults(t *testing.T) {
+	data := []byte("Authentication-Results: mx.example.org; dkim=pass\r\n" +
+		"Received: from a.example\r\n" +
+		"Authentication-Results: (forged)\r\n\tMX.example.org.\r\n\t1; dmarc=pass\r\n" +
+		"Authentication-Results: other.example; spf=pass\r\n" +
+		"authentication-results : \"mx.example.org\"; spf=pass\r\n" +
+		"Subject: hi\r\n" +
+		"\r\n" +
+		"Authentication-Results: mx.example.org; dkim=pass\r\n")
+
+	assert.Equal(t, "Received: from a.example\r\n"+
+		"Authentication-Results: other.example; spf=pass\r\n"+
+		"Subject: hi\r\n"+
+		"\r\n"+
+		"Authentication-Results: mx.example.org; dkim=pass\r\n", string(removeAuthenticationResults(data, "mx.example.org")))
+
+	unchanged := []byte("Authentication-Results: other.example; spf=pass\n\nhello\n")
+	assert.Equal(t, unchanged, removeAuthenticationResults(unchanged, "mx.example.org"))
+}
+
+func TestAuthServID(t *testing.T) {
+	assert.Equal(t, "mx.example.org", authServID(" mx.example.org; spf=pass"))
+	assert.Equal(t, "mx.example.org", authServID(" (a (nested) \\) comment) mx.example.org 1; spf=pass"))
+	assert.Equal(t, "mx.example.org", authServID("\r\n\t\"mx.example.org\";"))
+	assert.Equal(t, "", authServID(" ; spf=pass"))
+}
@@ -0,0 +1,70 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// A PanicError is reported to the Server's ErrorHook when a panic is recovered
+// from while serving a connection or running a Handler.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func newPanicError(v interface{}) *PanicError {
+	buf := make([]byte, 64<<10)
+	return &PanicError{Value: v, Stack: buf[:runtime.Stack(buf, false)]}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// report passes err to the ErrorHook, or logs it to logger if there is none.
+func (s *Server) report(logger *slog.Logger, err error) {
+	if s.ErrorHook != nil {
+		s.ErrorHook(err)
+		return
+	}
+
+	if perr, ok := err.(*PanicError); ok {
+		logger.Error("panic", slog.Any("value", perr.Value), slog.String("stack", string(perr.Stack)))
+		return
+	}
+
+	logger.Error("error", slog.Any("err", err))
+}
+
+// streamHandler returns the StreamHandler wrapped for the session, so that the
+// body includes any trace headers and a panic is reported and returned as an
+// error.
+func (s *Server) streamHandler(sess *session) StreamHandler {
+	return func(msg Message, r io.Reader) (err error) {
+		msg.ctx = sess.ctx
+		if headers := s.traceHeaders(sess, msg, time.Now(), s.eol()); len(headers) > 0 {
+			r = io.MultiReader(bytes.NewReader(headers), r)
+		}
+
+		started := time.Now()
+		defer func() {
+			s.Metrics.handler(time.Since(started))
+			if s.Hooks != nil {
+				s.Hooks.OnMessage(msg.ctx, msg, time.Since(started), err)
+			}
+		}()
+		defer func() {
+			if v := recover(); v != nil {
+				perr := newPanicError(v)
+				s.report(sess.logger, perr)
+				err = perr
+			}
+		}()
+
+		return s.stream(msg, r)
+	}
+}
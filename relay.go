@@ -0,0 +1,49 @@
+package smtp
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// checkRelay returns the reply to reject recipient with if it is not in one of
+// the Server's LocalDomains and the client may not relay, or an empty string.
+func (s *Server) checkRelay(sess *session, recipient string) string {
+	if len(s.LocalDomains) == 0 || sess.user != "" || sess.trusted {
+		return ""
+	}
+
+	if s.isLocal(recipient) {
+		return ""
+	}
+
+	sess.logger.Info("relay denied", slog.String("recipient", recipient))
+	return rRELAY_DENIED
+}
+
+// isLocal reports whether addr is in one of the Server's LocalDomains. An
+// address without a domain is not.
+func (s *Server) isLocal(addr string) bool {
+	if !strings.Contains(addr, "@") {
+		return false
+	}
+
+	_, domain := splitAddress(addr)
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	for _, local := range s.LocalDomains {
+		local = strings.TrimSuffix(strings.ToLower(local), ".")
+
+		if strings.HasPrefix(local, ".") {
+			if strings.HasSuffix(domain, local) {
+				return true
+			}
+			continue
+		}
+
+		if domain == local {
+			return true
+		}
+	}
+
+	return false
+}
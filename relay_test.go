@@ -0,0 +1,20 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsLocal(t *testing.T) {
+	s := &Server{LocalDomains: []string{"example.org", ".example.com."}}
+
+	assert.True(t, s.isLocal("jane.doe@example.org"))
+	assert.True(t, s.isLocal("jane.doe@EXAMPLE.org."))
+	assert.True(t, s.isLocal("john.doe@mail.example.com"))
+	assert.False(t, s.isLocal("john.doe@example.com"))
+	assert.False(t, s.isLocal("jane.doe@mail.example.org"))
+	assert.False(t, s.isLocal("jane.doe@notexample.org"))
+	assert.False(t, s.isLocal("jane.doe@example.org@example.net"))
+	assert.False(t, s.isLocal("jane.doe"))
+}
@@ -0,0 +1,28 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A Reply is an SMTP reply. A policy can return a *Reply as its error to choose
+// the reply sent to the client.
+type Reply struct {
+	Code    int
+	Message string
+}
+
+func (r *Reply) Error() string {
+	return fmt.Sprintf("%d %s", r.Code, r.Message)
+}
+
+// replyFor returns the reply to send for err, which is fallback unless err is a
+// *Reply.
+func replyFor(err error, fallback string) string {
+	var reply *Reply
+	if errors.As(err, &reply) {
+		return reply.Error()
+	}
+
+	return fallback
+}
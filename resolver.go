@@ -0,0 +1,32 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// lookupTimeout limits the time spent on the DNS lookups for a single check,
+// such as evaluating an SPF policy.
+const lookupTimeout = 20 * time.Second
+
+// A Resolver looks up DNS records. It is satisfied by *net.Resolver.
+type Resolver interface {
+	TXTResolver
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// A TXTResolver looks up DNS TXT records. It is satisfied by *net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+func (s *Server) resolver() Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+
+	return net.DefaultResolver
+}
@@ -3,9 +3,11 @@ package smtp
 
 import (
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,6 +18,24 @@ const (
 	rSYNTAX_ERROR = "501 Syntax error"
 	rCOMMAND_NOT_IMPLEMENTED = "502 Command not implemented"
 	rOUT_OF_SEQUENCE = "503 Command out of sequence"
+	rLOCAL_ERROR = "451 Requested action aborted: local error in processing"
+	rBUSY = "451 Requested action aborted: server busy, try again later"
+	rQUEUED = "250 2.0.0 Ok: queued as %s"
+	rTOO_MANY_HOPS = "554 5.4.6 Too many hops"
+	rSENDER_REJECTED = "550 5.7.1 Sender rejected"
+	rDMARC_REJECTED = "550 5.7.1 Rejected by DMARC policy"
+	rBLOCKLISTED = "554 5.7.1 Service unavailable; client host blocked"
+	rSENDER_BLOCKLISTED = "554 5.7.1 Sender domain blocked"
+	rNO_FCRDNS = "554 5.7.25 Client host rejected: reverse DNS validation failed"
+	rHELO_INVALID = "501 5.5.2 Invalid HELO name"
+	rHELO_FORGED = "550 5.7.1 HELO name rejected"
+	rGREYLISTED = "451 4.7.1 Greylisted, please try again later"
+	rEARLY_TALKER = "554 5.5.1 Protocol error: input before greeting"
+	rUNSYNCHRONISED = "554 5.5.1 Protocol error: input before reply"
+	rTOO_MANY_ERRORS = "421 4.7.0 Too many errors, closing connection"
+	rAUTH_LOCKED_OUT = "454 4.7.0 Temporary authentication failure, try again later"
+	rACCESS_DENIED = "554 5.7.1 Access denied"
+	rRELAY_DENIED = "554 5.7.1 Relay access denied"
 )
 
 // User represents an account that can receive mail with a name and address
@@ -27,6 +47,12 @@ type User struct {
 // A Handler receives Messages when transactions are completed.
 type Handler func(Message)
 
+// A StreamHandler receives the body of a Message as it is read from the
+// connection, rather than after it has been buffered. The Message given will
+// have a nil Data field. If an error is returned the client is told that the
+// message could not be accepted.
+type StreamHandler func(Message, io.Reader) error
+
 // A Verifier verifies whether its argument represents a user or email address
 // on the system, and if so returns the details as a User; otherwise an empty
 // User is returned.
@@ -38,30 +64,222 @@ type Expander func(string) []User
 type Server struct {
 	name     string
 	ln       net.Listener
-	out      chan Message
 	quit     chan struct{}
 
-	handlers []Handler
+	mu       sync.RWMutex
+	handlers []*handler
+	workers  sync.Once
+	queue    chan Message
+
+	// queueMu guards closed, which stops Messages being queued once the Server
+	// is closed; running counts the workers still handling the queue.
+	queueMu sync.RWMutex
+	closed  bool
+	running sync.WaitGroup
+
+	stream   StreamHandler
 	verifier Verifier
 	expander Expander
 
+	senderPolicy SenderPolicy
+
 	CramAuthenticator func(string) string
+
+	// SpoolThreshold, if greater than zero, causes message bodies to be read
+	// fully before being passed to the StreamHandler. Bodies are kept in memory
+	// up to this many bytes, after which they are written to a temporary file in
+	// SpoolDir (or the default temporary directory if empty). If zero the
+	// StreamHandler reads directly from the connection.
+	SpoolThreshold int64
+	SpoolDir       string
+
+	// RawData, if true, delivers message bodies exactly as they were sent, only
+	// removing dot-stuffing and the terminating line, so that CRLF line endings
+	// are preserved. By default line endings are normalised to LF.
+	RawData bool
+
+	// Workers is the number of goroutines that run Handlers, and so the number
+	// of Messages that can be handled at once. QueueSize is the number of
+	// Messages that can wait for a worker; when the queue is full further
+	// Messages are refused with a 451 reply. If zero they default to 1 and 100.
+	// Both must be set before the first Message is received.
+	Workers   int
+	QueueSize int
+
+	// ErrorHook, if set, is called with errors that occur while serving
+	// connections, including a *PanicError for any panic recovered from a
+	// Handler, StreamHandler, Verifier, Expander or CramAuthenticator. If nil
+	// errors are logged.
+	ErrorHook func(error)
+
+	// Logger is used to log the progress of each connection. Session start and
+	// end, commands and replies are logged at Debug level, and events such as
+	// rejections at Info. If nil the default slog Logger is used.
+	Logger *slog.Logger
+
+	// RedactAuth, if true, hides the arguments of AUTH commands and responses
+	// to AUTH challenges when logging.
+	RedactAuth bool
+
+	// Metrics, if set, collects counts of connections, commands, messages and
+	// authentication attempts, and timings of sessions and Handlers.
+	Metrics *Metrics
+
+	// Hooks, if set, are called at each step of serving a connection.
+	Hooks Hooks
+
+	// AddReceived, if true, prepends a Received header to each Message
+	// recording the client and this Server. AddReturnPath, if true, prepends a
+	// Return-Path header with the sender of the Message.
+	AddReceived   bool
+	AddReturnPath bool
+
+	// Resolver is used for DNS lookups. If nil net.DefaultResolver is used.
+	Resolver Resolver
+
+	// QueueID, if set, is used to generate the ID given to each Message. It
+	// must return unique values. If nil NewQueueID is used.
+	QueueID func() string
+
+	// MaxHops is the number of Received and Delivered-To headers a Message may
+	// have before it is rejected as looping. If zero the limit is 100, as
+	// suggested by RFC 5321; if negative there is no limit.
+	MaxHops int
+
+	// VerifySPF, if true, evaluates the SPF policy of the sender of each
+	// message, or of the HELO name for bounces, using Resolver. The result is
+	// given to any SenderPolicy, and recorded in each Message and in a
+	// Received-SPF header prepended to it. The HELO name, if a fully qualified
+	// domain name, is also checked on its own as recommended by RFC 7208
+	// section 2.3; that result is given in the Session, and recorded in a
+	// second Received-SPF header.
+	VerifySPF bool
+
+	// VerifyDKIM, if true, verifies the DKIM signatures of each Message using
+	// Resolver to find keys, recording the results in the Message. Messages
+	// passed to a StreamHandler are only verified if they are spooled.
+	VerifyDKIM bool
+
+	// VerifyDMARC, if true, evaluates the DMARC policy of the domain in the
+	// From field of each Message using the results of VerifySPF and VerifyDKIM,
+	// which should also be set. The result is recorded in the Message, and in an
+	// Authentication-Results header prepended to it. A Message whose DKIM
+	// signatures were not verified, such as one passed to a StreamHandler
+	// without being spooled, cannot fail DMARC: it is given a temperror result
+	// instead, and so is never rejected by EnforceDMARC.
+	VerifyDMARC bool
+
+	// EnforceDMARC, if true, rejects messages that fail DMARC when the domain's
+	// policy is reject. Messages with a quarantine policy are still accepted,
+	// and should be identified by their DMARC result.
+	EnforceDMARC bool
+
+	// VerifyARC, if true, validates the ARC chain of each Message using
+	// Resolver to find keys, recording the result in the Message and in an
+	// Authentication-Results header prepended to it. As for VerifyDKIM,
+	// messages passed to a StreamHandler are only validated if they are
+	// spooled.
+	VerifyARC bool
+
+	// Blocklists are checked using Resolver when a client connects, or for
+	// lists of domains when it gives a sender. Any listings are recorded in the
+	// Session.
+	Blocklists []Blocklist
+
+	// BlocklistReply is sent in place of the greeting to clients listed on a
+	// Blocklist that rejects them. If empty a 554 reply is used.
+	BlocklistReply string
+
+	// VerifyFCrDNS, if true, looks up the reverse DNS names of each client's
+	// address, recording in the Session the first that resolves back to it.
+	// RequireFCrDNS also refuses clients without one.
+	VerifyFCrDNS  bool
+	RequireFCrDNS bool
+
+	// CheckHelo, if true, validates the name given in HELO and EHLO: it must be
+	// a fully qualified domain name or an address literal. The result is
+	// recorded in the Session, and names claiming to be the Server, or the
+	// address the client connected to, are rejected. StrictHelo also replies
+	// 501 to missing or invalid names.
+	CheckHelo  bool
+	StrictHelo bool
+
+	// Greylist, if set, temporarily rejects recipients from clients that have
+	// not been seen before. Authenticated clients are never greylisted.
+	Greylist *Greylist
+
+	// GreetingDelay is how long to wait before greeting each client. Clients
+	// that send anything in that time are rejected.
+	GreetingDelay time.Duration
+
+	// RejectUnsynchronised, if true, rejects clients that send a command
+	// before receiving the reply to the last, as the Server does not offer
+	// PIPELINING.
+	RejectUnsynchronised bool
+
+	// Tarpit, if set, delays the replies to clients that make repeated errors
+	// and disconnects those that make too many.
+	Tarpit *Tarpit
+
+	// AuthLimiter, if set, locks out client addresses and usernames that fail
+	// to authenticate too many times.
+	AuthLimiter *AuthLimiter
+
+	// Access, if set, decides which clients may connect, and which are trusted
+	// to relay mail without authenticating. Its rules are checked as each
+	// connection is accepted, so may be changed while the Server is running.
+	Access *AccessPolicy
+
+	// LocalDomains, if set, are the domains the Server accepts mail for. Mail
+	// to other domains is only accepted from authenticated clients, or clients
+	// trusted by Access; others are refused so that the Server is not an open
+	// relay. A domain starting with "." matches its subdomains.
+	LocalDomains []string
+
+	// Postmaster, if set, receives the Messages sent to the postmaster of the
+	// Server, or to its RoleMailboxes, in place of the Handlers. A Message for
+	// other recipients too is split, with each part given only its own
+	// recipients. Messages passed to a StreamHandler are not routed.
+	//
+	// Recipients at postmaster, either bare or at the Server's name or one of
+	// its LocalDomains, are always accepted, as required by RFC 5321.
+	Postmaster Handler
+
+	// RoleMailboxes are local parts, such as "abuse", that are accepted and
+	// routed as postmaster is at the Server's name and LocalDomains.
+	RoleMailboxes []string
+
+	// ProxyNetworks are the networks of proxies, such as load balancers, that
+	// prefix connections with a PROXY protocol header giving the address of
+	// the client. Versions 1 and 2 of the protocol are accepted, and Access and
+	// all other checks then apply to the client's address. Connections from
+	// these networks without a valid header are closed; those from elsewhere
+	// are never expected to send one.
+	ProxyNetworks []*net.IPNet
 }
 
 // Listen creates a new Server listening at the local network address laddr and
 // will announce itself to new connections with the name given.
+//
+// The Server accepts connections as soon as it is returned, so its exported
+// fields must not be changed; use New and Start to configure a Server first.
 func Listen(laddr, name string) (*Server, error) {
-	tcp, err := net.Listen("tcp", laddr)
-	if err != nil {
+	s := New(name)
+	if err := s.Start(laddr); err != nil {
 		return nil, err
 	}
 
-	s := &Server{
+	return s, nil
+}
+
+// New creates a new Server that will announce itself to new connections with
+// the name given. It does not accept connections until Start is called, so can
+// be configured first.
+func New(name string) *Server {
+	return &Server{
 		name:     name,
-		ln:       tcp,
-		out:      make(chan Message),
 		quit:     make(chan struct{}),
-	  handlers: []Handler{},
+	  handlers: []*handler{},
 	  verifier: func(_ string) User {
 			return User{}
 		},
@@ -69,17 +287,48 @@ func Listen(laddr, name string) (*Server, error) {
 			return []User{}
 		},
 	}
+}
+
+// Start listens at the local network address laddr and begins accepting
+// connections, serving each in a new goroutine, until the Server is closed. The
+// exported fields of the Server must not be changed once it has been called;
+// use AccessPolicy.SetRules to change which clients are accepted.
+func (s *Server) Start(laddr string) error {
+	tcp, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
 
+	s.ln = tcp
 	go s.start()
-	go s.handle()
 
-	return s, nil
+	return nil
 }
 
 // Handle registers a new Handler to the Server. All Handlers will be run for
 // each Message received, on completion of a mail transaction.
-func (s *Server) Handle(handler Handler) {
-	s.handlers = append(s.handlers, handler)
+func (s *Server) Handle(fn Handler) {
+	s.HandleLimit(fn, 0)
+}
+
+// HandleLimit registers a new Handler to the Server, as Handle, that will be
+// run for at most n Messages at once. If n is zero there is no limit.
+func (s *Server) HandleLimit(fn Handler, n int) {
+	h := &handler{fn: fn}
+	if n > 0 {
+		h.sem = make(chan struct{}, n)
+	}
+
+	s.mu.Lock()
+	s.handlers = append(s.handlers, h)
+	s.mu.Unlock()
+}
+
+// Stream registers a StreamHandler to the Server. When a StreamHandler is
+// registered it receives every Message in place of any Handlers. If a
+// StreamHandler was previously registered it is overwritten.
+func (s *Server) Stream(handler StreamHandler) {
+	s.stream = handler
 }
 
 // Verify registers the Verifier to be used when a VRFY command is issued to the
@@ -94,11 +343,41 @@ func (s *Server) Expand(expander Expander) {
 	s.expander = expander
 }
 
-// Close stops the Server from accepting new connections and listening.
+// Close stops the Server from accepting new connections and listening. It
+// waits for the Handlers to be run for every Message already queued; Messages
+// completed after it is called are refused.
 func (s *Server) Close() error {
 	// TODO: Make sure Close() kills in-progress transactions.
+	s.queueMu.Lock()
+	s.closed = true
+	s.queueMu.Unlock()
+
 	close(s.quit)
-	return s.ln.Close()
+
+	var err error
+	if s.ln != nil {
+		err = s.ln.Close()
+	}
+
+	s.running.Wait()
+	return err
+}
+
+// eol returns the line ending used for message bodies.
+func (s *Server) eol() string {
+	if s.RawData {
+		return "\r\n"
+	}
+
+	return "\n"
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+
+	return slog.Default()
 }
 
 func (s *Server) start() {
@@ -109,61 +388,132 @@ func (s *Server) start() {
 			case <-s.quit:
 				return
 			default:
-				log.Println("start:", err)
+				s.logger().Error("accept", slog.Any("err", err))
 				continue
 			}
 		}
 
-		go s.serve(newConn(conn), conn)
+		if s.fromProxy(conn.RemoteAddr()) {
+			go s.serveProxied(conn)
+			continue
+		}
+
+		rule := s.Access.match(addrIP(conn.RemoteAddr()))
+		if rule.Action == AccessDeny {
+			go s.deny(conn, rule)
+			continue
+		}
+
+		go s.serve(conn, rule.Action == AccessTrust)
 	}
 }
 
-func (s *Server) handle() {
-	for {
-		msg := <-s.out
-		for _, handler := range s.handlers {
-			handler(msg)
+func (s *Server) serve(conn net.Conn, trusted bool) {
+	sess := s.newSession(conn)
+	sess.trusted = trusted
+	text := newConn(conn, sess)
+
+	sess.logger.Debug("session start")
+	s.Metrics.connectionOpened()
+	defer func() {
+		s.Metrics.connectionClosed(time.Since(sess.started))
+		sess.logger.Debug("session end")
+		sess.close()
+	}()
+
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			text.write(rLOCAL_ERROR)
+			s.report(sess.logger, newPanicError(r))
 		}
+	}()
+
+	if reply := s.checkClient(sess); reply != "" {
+		refuse(text, reply)
+		return
 	}
-}
 
-func (s *Server) serve(text connection, closer io.Closer) {
-	defer closer.Close()
+	if s.GreetingDelay > 0 && text.inputWithin(s.GreetingDelay) {
+		sess.logger.Info("early talker")
+		text.write(rEARLY_TALKER)
+		return
+	}
 
 	text.write("220 %s", s.name)
 	transaction := newTransaction()
 
 loop:
 	for {
+		if sess.tooManyErrors() {
+			sess.logger.Info("too many errors", slog.Int("errors", sess.errors))
+			text.write(rTOO_MANY_ERRORS)
+			return
+		}
+
 		cmd, rest, err := text.read()
 		if err != nil {
 			if err == io.EOF {
 				return
 			}
 
-			log.Println("read:", err)
+			sess.logger.Error("read", slog.Any("err", err))
+			return
+		}
+
+		cmd = strings.ToUpper(cmd)
+		s.Metrics.command(cmd)
+
+		if s.RejectUnsynchronised && text.pending() {
+			sess.logger.Info("unsynchronised input", slog.String("command", cmd))
+			text.write(rUNSYNCHRONISED)
 			return
 		}
 
-		switch strings.ToUpper(cmd) {
+		switch cmd {
 		case "EHLO":
+			if reply := s.checkHelo(sess, rest); reply != "" {
+				text.write("%s", reply)
+				continue
+			}
+
+			sess.setHelo(rest, true)
 			transaction = resetTransaction(transaction)
 			text.write("250-%s at your service", s.name)
 			text.write("250 8BITMIME")
 
 		case "HELO":
+			if reply := s.checkHelo(sess, rest); reply != "" {
+				text.write("%s", reply)
+				continue
+			}
+
+			sess.setHelo(rest, false)
 			transaction = resetTransaction(transaction)
 			text.write("250 %s at your service", s.name)
 
 		case "MAIL":
-			transaction = mail(rest, text, transaction)
+			transaction = mail(rest, text, transaction, func(sender string) string {
+				return s.checkSender(sess, sender)
+			})
 
 		case "RCPT":
-			transaction = rcpt(rest, text, transaction)
+			transaction = rcpt(rest, text, transaction, func(recipient string) string {
+				return s.checkRecipient(sess, recipient)
+			})
 
 		case "DATA":
-			if message, ok := data(text, transaction); ok {
-				s.out <- message
+			if s.stream != nil {
+				n, accepted, ok := s.dataStream(sess, text, transaction)
+				if ok {
+					s.Metrics.message(accepted, n)
+					transaction = resetTransaction(transaction)
+				}
+				continue
+			}
+
+			if message, ok := data(text, transaction, s.RawData); ok {
+				s.receive(sess, text, message)
 				transaction = resetTransaction(transaction)
 			}
 
@@ -204,31 +554,48 @@ loop:
 			text.write(rCOMMAND_NOT_IMPLEMENTED)
 
 		case "AUTH":
+			if s.authLockedOut(sess, "") {
+				text.write(rAUTH_LOCKED_OUT)
+				continue
+			}
+
 			auth := CramAuthenticator(s.CramAuthenticator)
 
 			toClient, err := auth.Start()
 			if err != nil {
-				log.Println(err)
+				sess.logger.Error("AUTH", slog.Any("err", err))
 				return
 			}
 
 			text.write("334 %s", toClient)
 
-			user, rest, err := text.read()
+			user, rest, err := text.readAuth()
 			if err != nil {
 				if err == io.EOF {
 					return
 				}
 
-				log.Println("read:", err)
+				sess.logger.Error("read", slog.Any("err", err))
 				return
 			}
 
-			if auth.Auth(user, rest) {
+			if s.authLockedOut(sess, user) {
+				text.write(rAUTH_LOCKED_OUT)
+				continue
+			}
+
+			ok := auth.Auth(user, rest)
+			s.Metrics.auth(ok)
+			s.authResult(sess, user, ok)
+
+			if ok {
+				sess.user = user
+				sess.logger.Info("authenticated", slog.String("user", user))
 				text.write("235 Authentication successful")
 				continue
 			}
 
+			sess.logger.Warn("authentication failed", slog.String("user", user))
 			text.write("535 Authentication credentials invalid")
 			return
 
@@ -12,14 +12,30 @@ import (
 	"encoding/base64"
 	"crypto/md5"
 	"crypto/hmac"
+	"errors"
+	"os"
+	"path/filepath"
+	"bytes"
+	"sync"
+	"log/slog"
+	"net/http/httptest"
+	"context"
+	"net"
+	"regexp"
 )
 
 const (
 	ADDR = ":9026"
 	NAME = "mx.test.server"
 	TIMEOUT = 10 * time.Millisecond
+
+	// VERIFY_TIMEOUT is used for replies that wait on verifying signatures,
+	// which is much slower under the race detector.
+	VERIFY_TIMEOUT = time.Second
 )
 
+var QUEUED = regexp.MustCompile(`^250 2\.0\.0 Ok: queued as [0-9A-Z]{16}$`)
+
 type Client struct {
 	text *textproto.Conn
 	t    *testing.T
@@ -43,6 +59,10 @@ func (c Client) Send(format string, args ...interface{}) {
 }
 
 func (c Client) ReadLine() string {
+	return c.ReadLineWithin(TIMEOUT)
+}
+
+func (c Client) ReadLineWithin(timeout time.Duration) string {
 	lines := make(chan string, 1)
 
 	go func() {
@@ -57,7 +77,7 @@ func (c Client) ReadLine() string {
 	select {
 	case line := <-lines:
 		return line
-	case <-time.After(TIMEOUT):
+	case <-time.After(timeout):
 		return ""
 	}
 }
@@ -89,6 +109,102 @@ func (c Client) Skip(num int) {
 	}
 }
 
+// SendMessage sends a complete mail transaction, returning the reply given at
+// the end of DATA.
+func (c Client) SendMessage(from, to, body string) string {
+	return c.SendMessageWithin(from, to, body, TIMEOUT)
+}
+
+// SendMessageWithin is SendMessage, waiting up to timeout for the reply given
+// at the end of DATA.
+func (c Client) SendMessageWithin(from, to, body string, timeout time.Duration) string {
+	c.Send("MAIL FROM:<%s>", from)
+	c.Skip(1)
+
+	c.Send("RCPT TO:<%s>", to)
+	c.Skip(1)
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("%s", body)
+	c.Send(".")
+	return c.ReadLineWithin(timeout)
+}
+
+// LogBuffer collects log output written from other goroutines.
+type LogBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *LogBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestResolver answers DNS lookups from an in-memory zone. Names are given
+// without a trailing dot.
+type TestResolver struct {
+	Addrs map[string][]string
+	IPs   map[string][]string
+	MX    map[string][]string
+	TXT   map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r TestResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.Addrs[addr]; ok {
+		return names, nil
+	}
+
+	return nil, notFound(addr)
+}
+
+func (r TestResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.IPs[strings.TrimSuffix(host, ".")]
+	if !ok {
+		return nil, notFound(host)
+	}
+
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (r TestResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := r.MX[strings.TrimSuffix(name, ".")]
+	if !ok {
+		return nil, notFound(name)
+	}
+
+	mxs := make([]*net.MX, len(hosts))
+	for i, host := range hosts {
+		mxs[i] = &net.MX{Host: host + ".", Pref: uint16(10 * (i + 1))}
+	}
+	return mxs, nil
+}
+
+func (r TestResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txts, ok := r.TXT[strings.TrimSuffix(name, ".")]; ok {
+		return txts, nil
+	}
+
+	return nil, notFound(name)
+}
+
 func NewServer(t *testing.T) *Server {
 	s, err := Listen(ADDR, NAME)
 	if err != nil {
@@ -109,6 +225,29 @@ func NewCatchServer(t *testing.T) (*Server, <-chan Message) {
 	return s, ch
 }
 
+// NewUnstartedServer returns a Server that can be configured before it is
+// started with StartServer.
+func NewUnstartedServer(t *testing.T) *Server {
+	return New(NAME)
+}
+
+func NewUnstartedCatchServer(t *testing.T) (*Server, <-chan Message) {
+	s := NewUnstartedServer(t)
+
+	ch := make(chan Message)
+	s.Handle(func(m Message) {
+		ch <- m
+	})
+
+	return s, ch
+}
+
+func StartServer(t *testing.T, s *Server) {
+	if err := s.Start(ADDR); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSenderRecipientBodyAndQuit(t *testing.T) {
 	assert := assert.New(t)
 
@@ -324,6 +463,104 @@ func TestVerify(t *testing.T) {
 	assert.Nil(c.Quit())
 }
 
+func TestConnectWithGreetingDelay(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.GreetingDelay = 20 * time.Millisecond
+
+	StartServer(t, s)
+
+	text, err := textproto.Dial("tcp", ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := text.ReadLine()
+	assert.Nil(t, err)
+	assert.Equal(t, "220 "+NAME, line)
+}
+
+func TestConnectWithEarlyTalker(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.GreetingDelay = 50 * time.Millisecond
+
+	StartServer(t, s)
+
+	text, err := textproto.Dial("tcp", ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{text, t}
+
+	c.Send("EHLO local.test")
+
+	line, err := text.ReadLine()
+	assert.Nil(t, err)
+	assert.Equal(t, "554 5.5.1 Protocol error: input before greeting", line)
+	assert.True(t, c.ReadClosed())
+}
+
+func TestUnsynchronisedInput(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.RejectUnsynchronised = true
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("NOOP")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.text.W.WriteString("MAIL FROM:<john.doe@example.com>\r\nRCPT TO:<jane.doe@example.org>\r\n")
+	c.text.W.Flush()
+
+	assert.Equal(t, "554 5.5.1 Protocol error: input before reply", c.ReadLine())
+	assert.True(t, c.ReadClosed())
+}
+
+func TestTarpit(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.Tarpit = &Tarpit{Delay: 20 * time.Millisecond, MaxErrors: 3}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL")
+	assert.Equal(t, "501 Syntax error", c.ReadLine())
+
+	c.Send("NOOP")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	start := time.Now()
+	c.Send("RCPT")
+	line, _ := c.text.ReadLine()
+	assert.Equal(t, "501 Syntax error", line)
+	assert.True(t, time.Since(start) >= 20 * time.Millisecond)
+
+	start = time.Now()
+	c.Send("WHAT")
+	line, _ = c.text.ReadLine()
+	assert.Equal(t, "500 Command unrecognized", line)
+	assert.True(t, time.Since(start) >= 40 * time.Millisecond)
+
+	assert.Equal(t, "421 4.7.0 Too many errors, closing connection", c.ReadLine())
+	assert.True(t, c.ReadClosed())
+}
+
 // HELO
 
 func TestHelo(t *testing.T) {
@@ -346,6 +583,156 @@ func TestHeloWithNoArgument(t *testing.T) {
 	assert.Equal(t, c.ReadLine(), "250 " + NAME + " at your service")
 }
 
+func TestHeloWithInvalidName(t *testing.T) {
+	s := NewServer(t)
+	defer s.Close()
+
+	c := NewClient(t)
+
+	c.Send("EHLO my host")
+	assert.Equal(t, "250-" + NAME + " at your service", c.ReadLine())
+}
+
+func TestHeloWithCheckHelo(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.CheckHelo = true
+
+	var sessions []Session
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		sessions = append(sessions, sess)
+		return nil
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("HELO " + NAME)
+	assert.Equal(t, "550 5.7.1 HELO name rejected", c.ReadLine())
+
+	c.Send("HELO bogus")
+	assert.Equal(t, "250 "+NAME+" at your service", c.ReadLine())
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("HELO local.test")
+	c.Skip(1)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	if assert.Len(t, sessions, 2) {
+		assert.Equal(t, "bogus", sessions[0].Helo)
+		assert.False(t, sessions[0].HeloValid)
+		assert.Equal(t, "local.test", sessions[1].Helo)
+		assert.True(t, sessions[1].HeloValid)
+	}
+}
+
+func TestHeloWithStrictHelo(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.StrictHelo = true
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	for _, name := range []string{"", "bogus", "-bad.example", "bad_name.example", "192.0.2.1", "host.123", "[192.0.2.300]", "[IPv6:192.0.2.1]"} {
+		c.Send("HELO %s", name)
+		assert.Equal(t, "501 5.5.2 Invalid HELO name", c.ReadLine(), name)
+	}
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "503 Command out of sequence", c.ReadLine())
+
+	for _, name := range []string{"local.test", "Mail-1.Example.COM.", "[192.0.2.1]", "[IPv6:2001:db8::1]"} {
+		c.Send("EHLO %s", name)
+		assert.Equal(t, "250-"+NAME+" at your service", c.ReadLine(), name)
+		c.Skip(1)
+	}
+}
+
+func TestHeloClaimingServerAddress(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.CheckHelo = true
+
+	StartServer(t, s)
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}}
+	conn, err := dialer.Dial("tcp", "127.0.0.2"+ADDR)
+	if err != nil {
+		t.Skip("cannot connect to 127.0.0.2:", err)
+	}
+	c := Client{textproto.NewConn(conn), t}
+	c.Skip(1)
+
+	c.Send("HELO [127.0.0.2]")
+	assert.Equal(t, "550 5.7.1 HELO name rejected", c.ReadLine())
+
+	c.Send("HELO [127.0.0.1]")
+	assert.Equal(t, "250 "+NAME+" at your service", c.ReadLine())
+}
+
+func TestConnectWithFCrDNS(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.VerifyFCrDNS = true
+	s.Resolver = TestResolver{
+		Addrs: map[string][]string{"127.0.0.1": {"other.example.", "client.example."}},
+		IPs: map[string][]string{
+			"other.example":  {"192.0.2.1"},
+			"client.example": {"127.0.0.1"},
+		},
+	}
+
+	sessions := make(chan Session, 1)
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		sessions <- sess
+		return nil
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	assert.Equal(t, "client.example", (<-sessions).ReverseName)
+}
+
+func TestConnectWithRequiredFCrDNS(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.RequireFCrDNS = true
+	s.Resolver = TestResolver{
+		Addrs: map[string][]string{"127.0.0.1": {"other.example."}},
+		IPs:   map[string][]string{"other.example": {"192.0.2.1"}},
+	}
+
+	StartServer(t, s)
+
+	text, err := textproto.Dial("tcp", ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{text, t}
+
+	assert.Equal(t, "554 5.7.25 Client host rejected: reverse DNS validation failed", c.ReadLine())
+}
+
 // EHLO
 
 func TestEhlo(t *testing.T) {
@@ -428,74 +815,880 @@ func TestMailWithoutEhlo(t *testing.T) {
 	assert.Equal(t, c.ReadLine(), "503 Command out of sequence")
 }
 
-// RCPT
-
-func TestRcpt(t *testing.T) {
-	s := NewServer(t)
+func TestMailWithSenderPolicy(t *testing.T) {
+	s := NewUnstartedServer(t)
 	defer s.Close()
 
-	c := NewClient(t)
+	s.VerifySPF = true
+	s.Resolver = TestResolver{TXT: map[string][]string{
+		"example.com": {"v=spf1 ip4:127.0.0.0/8 -all"},
+		"example.org": {"v=spf1 -all"},
+	}}
 
-	c.Send("EHLO local.test")
-	c.Skip(2)
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		assert.Equal(t, "local.test", sess.Helo)
 
-	c.Send("MAIL FROM:<john.doe@example.com>")
-	c.Skip(1)
+		switch spf {
+		case SPFPass:
+			return nil
+		case SPFFail:
+			return &Reply{550, "5.7.23 SPF validation failed"}
+		default:
+			return errors.New("no")
+		}
+	})
 
-	c.Send("RCPT TO:<other.john@example.com>")
-	assert.Equal(t, c.ReadLine(), "250 Ok")
-}
+	StartServer(t, s)
 
-func TestRcptWithSyntaxErrors(t *testing.T) {
-	s := NewServer(t)
-	defer s.Close()
+	c := NewClient(t)
 
-	for _, testCase := range []string{
-		"RCPT TO:<>",
-		"RCPT TO:<john.doe@example.com",
-		"RCPT TO:",
-		"RCPT FROM:<john.doe@example.com",
-		"RCPT",
-	} {
-		c := NewClient(t)
+	c.Send("EHLO local.test")
+	c.Skip(2)
 
-		c.Send("EHLO local.test")
-		c.Skip(2)
+	c.Send("MAIL FROM:<john.doe@example.org>")
+	assert.Equal(t, "550 5.7.23 SPF validation failed", c.ReadLine())
 
-		c.Send("MAIL FROM:<john.doe@example.com>")
-		c.Skip(1)
+	c.Send("MAIL FROM:<john.doe@example.net>")
+	assert.Equal(t, "550 5.7.1 Sender rejected", c.ReadLine())
 
-		c.Send(testCase)
-		assert.Equal(t, c.ReadLine(), "501 Syntax error")
-	}
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	assert.Equal(t, "503 Command out of sequence", c.ReadLine())
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
 }
 
-func TestRcptWithoutMail(t *testing.T) {
-	s := NewServer(t)
+func TestMailWithPolicyReplyContainingPercent(t *testing.T) {
+	s := NewUnstartedServer(t)
 	defer s.Close()
 
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		return &Reply{550, "5.7.1 100% spam"}
+	})
+
+	StartServer(t, s)
+
 	c := NewClient(t)
 
 	c.Send("EHLO local.test")
 	c.Skip(2)
 
-	c.Send("RCPT TO:<other.john@example.com>")
-	assert.Equal(t, c.ReadLine(), "503 Command out of sequence")
+	c.Send("MAIL FROM:<john.doe@example.org>")
+	assert.Equal(t, "550 5.7.1 100% spam", c.ReadLine())
 }
 
-// DATA
-
-func TestData(t *testing.T) {
-	s, ch := NewCatchServer(t)
+func TestDataAfterRejectedSender(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
 	defer s.Close()
 
+	s.VerifySPF = true
+	s.Resolver = TestResolver{TXT: map[string][]string{
+		"example.com": {"v=spf1 ip4:127.0.0.1 -all"},
+		"example.org": {"v=spf1 -all"},
+	}}
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		if spf == SPFFail {
+			return errors.New("no")
+		}
+		return nil
+	})
+
+	StartServer(t, s)
+
 	c := NewClient(t)
 
 	c.Send("EHLO local.test")
 	c.Skip(2)
 
 	c.Send("MAIL FROM:<john.doe@example.com>")
-	c.Skip(1)
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("MAIL FROM:<john.doe@example.org>")
+	assert.Equal(t, "550 5.7.1 Sender rejected", c.ReadLine())
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("hello")
+	c.Send(".")
+	assert.Regexp(t, QUEUED, c.ReadLine())
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, "john.doe@example.com", msg.Sender)
+		assert.Equal(t, SPFPass, msg.SPF)
+		assert.Contains(t, string(msg.Data), "smtp.mailfrom=john.doe@example.com")
+	case <-time.After(TIMEOUT):
+		t.Fatal("timed out")
+	}
+}
+
+func TestDataWithReceivedSPF(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.VerifySPF = true
+	s.Resolver = TestResolver{TXT: map[string][]string{
+		"example.com": {"v=spf1 ip4:127.0.0.1 -all"},
+		"local.test":  {"v=spf1 -all"},
+	}}
+
+	heloResults := make(chan SPFResult, 1)
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		heloResults <- sess.HeloSPF
+		return nil
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "hello"))
+	assert.Equal(t, SPFFail, <-heloResults)
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, SPFPass, msg.SPF)
+		assert.Equal(t, "Received-SPF: pass (mx.test.server: domain of john.doe@example.com designates 127.0.0.1 as permitted sender)\n"+
+			"\tclient-ip=127.0.0.1; envelope-from=\"john.doe@example.com\"; helo=local.test;\n"+
+			"\tidentity=mailfrom; receiver=mx.test.server;\n"+
+			"Received-SPF: fail (mx.test.server: domain of local.test does not designate 127.0.0.1 as permitted sender)\n"+
+			"\tclient-ip=127.0.0.1; envelope-from=\"john.doe@example.com\"; helo=local.test;\n"+
+			"\tidentity=helo; receiver=mx.test.server;\n"+
+			"Authentication-Results: mx.test.server;\n"+
+			"\tspf=pass smtp.mailfrom=john.doe@example.com;\n"+
+			"\tspf=fail smtp.helo=local.test\n"+
+			"hello\n", string(msg.Data))
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestDataWithForgedAuthenticationResults(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.VerifySPF = true
+	s.Resolver = TestResolver{}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org",
+		"Authentication-Results: mx.test.server;\n\tdmarc=pass header.from=example.com\n"+
+			"Authentication-Results: other.example; spf=pass\n\nhello"))
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, "Received-SPF: none (mx.test.server: domain of john.doe@example.com does not designate permitted sender hosts)\n"+
+			"\tclient-ip=127.0.0.1; envelope-from=\"john.doe@example.com\"; helo=local.test;\n"+
+			"\tidentity=mailfrom; receiver=mx.test.server;\n"+
+			"Received-SPF: none (mx.test.server: domain of local.test does not designate permitted sender hosts)\n"+
+			"\tclient-ip=127.0.0.1; envelope-from=\"john.doe@example.com\"; helo=local.test;\n"+
+			"\tidentity=helo; receiver=mx.test.server;\n"+
+			"Authentication-Results: mx.test.server;\n"+
+			"\tspf=none smtp.mailfrom=john.doe@example.com;\n"+
+			"\tspf=none smtp.helo=local.test\n"+
+			"Authentication-Results: other.example; spf=pass\n\nhello\n", string(msg.Data))
+	case <-time.After(TIMEOUT):
+		t.Fatal("timed out")
+	}
+}
+
+func TestDataStreamWithForgedAuthenticationResults(t *testing.T) {
+	for _, threshold := range []int64{0, 8} {
+		s := NewUnstartedServer(t)
+
+		s.VerifySPF = true
+		s.Resolver = TestResolver{}
+		s.SpoolThreshold = threshold
+
+		bodies := make(chan []byte, 1)
+		s.Stream(func(msg Message, r io.Reader) error {
+			body, err := io.ReadAll(r)
+			bodies <- body
+			return err
+		})
+
+		StartServer(t, s)
+
+		c := NewClient(t)
+
+		c.Send("EHLO local.test")
+		c.Skip(2)
+
+		assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org",
+			"Subject: hi\nAuthentication-Results: mx.test.server; dmarc=pass\n\nhello"))
+
+		select {
+		case body := <-bodies:
+			assert.True(t, strings.HasSuffix(string(body), "\tspf=none smtp.helo=local.test\nSubject: hi\n\nhello\n"), string(body))
+		case <-time.After(TIMEOUT):
+			t.Fatal("timed out")
+		}
+
+		s.Close()
+	}
+}
+
+func TestDataWithDKIM(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.VerifyDKIM = true
+	s.Resolver = dkimResolver
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessageWithin("joe@football.example.com", "suzie@shopping.example.net", strings.TrimSuffix(dkimMessage, "\n"), VERIFY_TIMEOUT))
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, []DKIMStatus{DKIMPass, DKIMPass}, statuses(msg.DKIM))
+	case <-time.After(VERIFY_TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestDataWithDMARC(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.VerifySPF = true
+	s.VerifyDKIM = true
+	s.VerifyDMARC = true
+	s.Resolver = TestResolver{TXT: map[string][]string{
+		"brisbane._domainkey.football.example.com": dkimResolver.TXT["brisbane._domainkey.football.example.com"],
+		"test._domainkey.football.example.com":     dkimResolver.TXT["test._domainkey.football.example.com"],
+		"_dmarc.example.com":                       {"v=DMARC1; p=reject"},
+	}}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessageWithin("bounces@mail.example.net", "suzie@shopping.example.net", strings.TrimSuffix(dkimMessage, "\n"), VERIFY_TIMEOUT))
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, DMARCResult{Status: DMARCPass, Domain: "football.example.com", Policy: DMARCPolicyReject, DKIMAligned: true}, msg.DMARC)
+		assert.Contains(t, string(msg.Data), "\nAuthentication-Results: mx.test.server;\n"+
+			"\tspf=none smtp.mailfrom=bounces@mail.example.net;\n"+
+			"\tspf=none smtp.helo=local.test;\n"+
+			"\tdkim=pass header.d=football.example.com header.s=brisbane header.i=@football.example.com;\n"+
+			"\tdkim=pass header.d=football.example.com header.s=test header.i=@football.example.com;\n"+
+			"\tdmarc=pass header.from=football.example.com\n"+
+			"DKIM-Signature: ")
+	case <-time.After(VERIFY_TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestDataWithEnforcedDMARC(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.VerifyDKIM = true
+	s.VerifyDMARC = true
+	s.EnforceDMARC = true
+	s.Resolver = TestResolver{TXT: map[string][]string{
+		"_dmarc.example.com":        {"v=DMARC1; p=none; sp=reject"},
+		"_dmarc.quarantine.example": {"v=DMARC1; p=quarantine"},
+	}}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Equal(t, "550 5.7.1 Rejected by DMARC policy",
+		c.SendMessage("john.doe@example.com", "jane.doe@example.org", "From: <john.doe@mail.example.com>\n\nhello"))
+
+	c.Send("RSET")
+	c.Skip(1)
+
+	assert.Regexp(t, QUEUED,
+		c.SendMessage("john.doe@example.com", "jane.doe@example.org", "From: <john.doe@quarantine.example>\n\nhello"))
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, DMARCFail, msg.DMARC.Status)
+		assert.Equal(t, DMARCPolicyQuarantine, msg.DMARC.Policy)
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestDataStreamWithUnverifiedDMARC(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.VerifyDKIM = true
+	s.VerifyDMARC = true
+	s.EnforceDMARC = true
+	s.Resolver = TestResolver{TXT: map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	}}
+
+	results := make(chan DMARCResult, 1)
+	s.Stream(func(msg Message, r io.Reader) error {
+		results <- msg.DMARC
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED,
+		c.SendMessage("john.doe@example.net", "jane.doe@example.org", "From: <john.doe@example.com>\n\nhello"))
+
+	select {
+	case result := <-results:
+		assert.Equal(t, DMARCTempError, result.Status)
+	case <-time.After(TIMEOUT):
+		t.Fatal("timed out")
+	}
+}
+
+func TestDataWithRejectedRecipient(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.LocalDomains = []string{"example.org"}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<victim@example.net>")
+	assert.Equal(t, "554 5.7.1 Relay access denied", c.ReadLine())
+
+	c.Send("RCPT TO:<joe.doe@example.org>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("Hey")
+	c.Send(".")
+	assert.Regexp(t, QUEUED, c.ReadLine())
+
+	select {
+	case m := <-ch:
+		assert.Equal(t, []string{"jane.doe@example.org", "joe.doe@example.org"}, m.Recipients)
+	case <-time.After(TIMEOUT):
+		t.Fatal("timed out")
+	}
+}
+
+func TestDataWithPostmaster(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	postmaster := make(chan Message)
+	s.Postmaster = func(m Message) {
+		postmaster <- m
+	}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<postmaster>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("Hey")
+	c.Send(".")
+	assert.Regexp(t, QUEUED, c.ReadLine())
+
+	select {
+	case m := <-postmaster:
+		assert.Equal(t, []string{"postmaster"}, m.Recipients)
+		assert.Equal(t, "Hey\n", string(m.Data))
+	case <-time.After(TIMEOUT):
+		t.Fatal("timed out")
+	}
+
+	select {
+	case m := <-ch:
+		assert.Equal(t, []string{"jane.doe@example.org"}, m.Recipients)
+		assert.Equal(t, "Hey\n", string(m.Data))
+	case <-time.After(TIMEOUT):
+		t.Fatal("timed out")
+	}
+}
+
+func TestDataWithPostmasterMetrics(t *testing.T) {
+	s := NewUnstartedServer(t)
+
+	s.Metrics = NewMetrics()
+	s.Postmaster = func(m Message) {}
+	s.Handle(func(m Message) {})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<postmaster>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("Hey")
+	c.Send(".")
+	assert.Regexp(t, QUEUED, c.ReadLine())
+
+	s.Close()
+
+	var buf bytes.Buffer
+	s.Metrics.WriteTo(&buf)
+	assert.Contains(t, buf.String(), "smtp_handler_duration_seconds_count 1\n")
+}
+
+func TestDataWithARC(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	first, _, resolver := newARCSealers(t)
+
+	s.VerifyARC = true
+	s.Resolver = resolver
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessageWithin("joe@football.example.com", "suzie@forwarder.example", strings.TrimSuffix(seal(t, first, arcMessage), "\n"), VERIFY_TIMEOUT))
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, ARCResult{Status: ARCPass, Instance: 1, Sealers: []string{"forwarder.example"}}, msg.ARC)
+		assert.True(t, strings.HasPrefix(string(msg.Data), "Authentication-Results: mx.test.server;\n\tarc=pass\nARC-Seal: i=1;"))
+	case <-time.After(VERIFY_TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestConnectWithAccessPolicy(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.Access = NewAccessPolicy([]AccessRule{
+		{Network: loopback, Action: AccessDeny, Reply: "554 5.7.1 Go away"},
+	})
+
+	StartServer(t, s)
+
+	text, err := textproto.Dial("tcp", ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{text, t}
+
+	assert.Equal(t, "554 5.7.1 Go away", c.ReadLine())
+	assert.True(t, c.ReadClosed())
+
+	s.Access.SetRules([]AccessRule{
+		{Network: loopback, Action: AccessTrust},
+	})
+
+	sessions := make(chan Session, 1)
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		sessions <- sess
+		return nil
+	})
+
+	c = NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+	assert.True(t, (<-sessions).Trusted)
+}
+
+func TestConnectThroughProxy(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.ProxyNetworks = []*net.IPNet{loopback}
+
+	sessions := make(chan Session, 1)
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		sessions <- sess
+		return nil
+	})
+
+	StartServer(t, s)
+
+	text, err := textproto.Dial("tcp", ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{text, t}
+
+	c.Send("PROXY TCP4 192.0.2.1 198.51.100.1 56324 25")
+	assert.Equal(t, "220 " + NAME, c.ReadLine())
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+	assert.Equal(t, "192.0.2.1:56324", (<-sessions).RemoteAddr.String())
+
+	text, err = textproto.Dial("tcp", ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = Client{text, t}
+
+	c.Send("EHLO local.test")
+	assert.True(t, c.ReadClosed())
+}
+
+func TestConnectWithBlocklist(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.Blocklists = []Blocklist{{Zone: "bl.example", Reject: true}}
+	s.Resolver = TestResolver{IPs: map[string][]string{
+		"1.0.0.127.bl.example": {"127.0.0.2"},
+	}}
+
+	StartServer(t, s)
+
+	text, err := textproto.Dial("tcp", ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{text, t}
+
+	assert.Equal(t, "554 5.7.1 Service unavailable; client host blocked", c.ReadLine())
+
+	c.Send("EHLO local.test")
+	assert.Equal(t, "503 Command out of sequence", c.ReadLine())
+
+	c.Send("QUIT")
+	assert.Equal(t, "221 Bye", c.ReadLine())
+	assert.True(t, c.ReadClosed())
+}
+
+func TestConnectWithBlocklistReply(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.Blocklists = []Blocklist{{Zone: "bl.example", Reject: true}}
+	s.BlocklistReply = "554 5.7.1 Go away"
+	s.Resolver = TestResolver{IPs: map[string][]string{
+		"1.0.0.127.bl.example": {"127.0.0.2"},
+	}}
+
+	StartServer(t, s)
+
+	text, err := textproto.Dial("tcp", ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{text, t}
+
+	assert.Equal(t, "554 5.7.1 Go away", c.ReadLine())
+}
+
+func TestMailWithBlocklists(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.Blocklists = []Blocklist{
+		{Zone: "score.example", Score: 5},
+		{Zone: "refused.example", Score: 10},
+		{Zone: "dbl.example", Domains: true, Score: 3},
+		{Zone: "bad.example", Domains: true, Reject: true},
+	}
+	s.Resolver = TestResolver{IPs: map[string][]string{
+		"1.0.0.127.score.example":   {"127.0.0.4", "127.0.0.10"},
+		"1.0.0.127.refused.example": {"127.255.255.254"},
+		"example.org.dbl.example":   {"127.0.1.2"},
+		"example.net.bad.example":   {"127.0.0.2"},
+	}}
+
+	var sessions []Session
+	s.CheckSender(func(sess Session, sender string, spf SPFResult) error {
+		sessions = append(sessions, sess)
+		return nil
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.net>")
+	assert.Equal(t, "554 5.7.1 Sender domain blocked", c.ReadLine())
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RSET")
+	c.Skip(1)
+
+	c.Send("MAIL FROM:<john.doe@example.org>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	ipListing := Listing{Blocklist: Blocklist{Zone: "score.example", Score: 5}, Name: "127.0.0.1", Codes: []string{"127.0.0.4", "127.0.0.10"}}
+	domainListing := Listing{Blocklist: Blocklist{Zone: "dbl.example", Domains: true, Score: 3}, Name: "example.org", Codes: []string{"127.0.1.2"}}
+
+	if assert.Len(t, sessions, 2) {
+		assert.Equal(t, []Listing{ipListing}, sessions[0].Listings)
+		assert.Equal(t, 5, sessions[0].Score)
+
+		assert.Equal(t, []Listing{ipListing, domainListing}, sessions[1].Listings)
+		assert.Equal(t, 8, sessions[1].Score)
+	}
+}
+
+// RCPT
+
+func TestRcpt(t *testing.T) {
+	s := NewServer(t)
+	defer s.Close()
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<other.john@example.com>")
+	assert.Equal(t, c.ReadLine(), "250 Ok")
+}
+
+func TestRcptWithSyntaxErrors(t *testing.T) {
+	s := NewServer(t)
+	defer s.Close()
+
+	for _, testCase := range []string{
+		"RCPT TO:<>",
+		"RCPT TO:<john.doe@example.com",
+		"RCPT TO:",
+		"RCPT FROM:<john.doe@example.com",
+		"RCPT",
+	} {
+		c := NewClient(t)
+
+		c.Send("EHLO local.test")
+		c.Skip(2)
+
+		c.Send("MAIL FROM:<john.doe@example.com>")
+		c.Skip(1)
+
+		c.Send(testCase)
+		assert.Equal(t, c.ReadLine(), "501 Syntax error")
+	}
+}
+
+func TestRcptWithoutMail(t *testing.T) {
+	s := NewServer(t)
+	defer s.Close()
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("RCPT TO:<other.john@example.com>")
+	assert.Equal(t, c.ReadLine(), "503 Command out of sequence")
+}
+
+func TestRcptWithLocalDomains(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.LocalDomains = []string{"example.org"}
+	s.Access = NewAccessPolicy(nil)
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<jane.doe@example.net>")
+	assert.Equal(t, "554 5.7.1 Relay access denied", c.ReadLine())
+
+	for _, recipient := range []string{
+		"jane.doe",
+		"jane.doe%example.net",
+		"jane.doe@example.net@example.org",
+		"jane.doe@example.net> <john.doe@example.org",
+	} {
+		c.Send("RCPT TO:<%s>", recipient)
+		assert.Equal(t, "501 Syntax error", c.ReadLine(), recipient)
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.Access.SetRules([]AccessRule{{Network: loopback, Action: AccessTrust}})
+
+	c = NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<jane.doe@example.net>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+}
+
+func TestRcptPostmaster(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.LocalDomains = []string{"example.org"}
+	s.RoleMailboxes = []string{"abuse"}
+	s.Greylist = &Greylist{}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<Postmaster>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<postmaster@example.org>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<abuse@" + NAME + ">")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	assert.Equal(t, "451 4.7.1 Greylisted, please try again later", c.ReadLine())
+
+	c.Send("RCPT TO:<postmaster@example.net>")
+	assert.Equal(t, "554 5.7.1 Relay access denied", c.ReadLine())
+}
+
+func TestRcptWithGreylist(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.Greylist = &Greylist{Delay: time.Nanosecond}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	assert.Equal(t, "451 4.7.1 Greylisted, please try again later", c.ReadLine())
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+}
+
+// DATA
+
+func TestData(t *testing.T) {
+	s, ch := NewCatchServer(t)
+	defer s.Close()
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
 
 	c.Send("RCPT TO:<jane.doe@example.org>")
 	c.Skip(1)
@@ -508,7 +1701,7 @@ func TestData(t *testing.T) {
 	c.Send("that was it")
 
 	c.Send(".")
-	assert.Equal(t, c.ReadLine(), "250 Ok")
+	assert.Regexp(t, QUEUED, c.ReadLine())
 
 	select {
 	case msg := <-ch:
@@ -523,60 +1716,564 @@ func TestData(t *testing.T) {
 	}
 }
 
-func TestDataWithEmptyBody(t *testing.T) {
-	s, ch := NewCatchServer(t)
+func TestDataWithEmptyBody(t *testing.T) {
+	s, ch := NewCatchServer(t)
+	defer s.Close()
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	assert.Equal(t, c.ReadLine(), "354 End data with <CRLF>.<CRLF>")
+
+	c.Send(".")
+	assert.Regexp(t, QUEUED, c.ReadLine())
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, "john.doe@example.com", msg.Sender)
+		if assert.Equal(t, 1, len(msg.Recipients)) {
+			assert.Equal(t, "jane.doe@example.org", msg.Recipients[0])
+		}
+		assert.Equal(t, []byte{}, msg.Data)
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestDataWithoutRcpt(t *testing.T) {
+	s, ch := NewCatchServer(t)
+	defer s.Close()
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	assert.Equal(t, c.ReadLine(), "503 Command out of sequence")
+
+	select {
+	case <-ch:
+	  t.Log("Should not have got a message")
+  case <-time.After(TIMEOUT):
+	}
+}
+
+func TestDataWithRawData(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.RawData = true
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("ok so here is the message")
+	c.Send("..with a dot")
+	c.Send(".")
+	assert.Regexp(t, QUEUED, c.ReadLine())
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, []byte("ok so here is the message\r\n.with a dot\r\n"), msg.Data)
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestDataStream(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	bodies := make(chan []byte, 1)
+	s.Stream(func(msg Message, r io.Reader) error {
+		assert.Equal(t, "john.doe@example.com", msg.Sender)
+		assert.Nil(t, msg.Data)
+
+		body, err := io.ReadAll(r)
+		bodies <- body
+		return err
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	assert.Equal(t, c.ReadLine(), "354 End data with <CRLF>.<CRLF>")
+
+	c.Send("ok so here is the message")
+	c.Send("..and it is streamed")
+	c.Send(".")
+	assert.Regexp(t, QUEUED, c.ReadLine())
+
+	select {
+	case body := <-bodies:
+		assert.Equal(t, []byte("ok so here is the message\n.and it is streamed\n"), body)
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestDataStreamWithSpool(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.SpoolThreshold = 8
+	s.SpoolDir = t.TempDir()
+
+	bodies := make(chan []byte, 1)
+	s.Stream(func(msg Message, r io.Reader) error {
+		_, isFile := r.(*os.File)
+		assert.True(t, isFile)
+
+		body, err := io.ReadAll(r)
+		bodies <- body
+		return err
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("this is longer than the threshold")
+	c.Send(".")
+	assert.Regexp(t, QUEUED, c.ReadLine())
+
+	select {
+	case body := <-bodies:
+		assert.Equal(t, []byte("this is longer than the threshold\n"), body)
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+
+	entries, _ := os.ReadDir(s.SpoolDir)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestDataStreamWithSpoolError(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.SpoolThreshold = 8
+	s.SpoolDir = filepath.Join(t.TempDir(), "missing")
+	s.Stream(func(msg Message, r io.Reader) error {
+		t.Error("StreamHandler called")
+		return nil
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("this is longer than the threshold")
+	c.Send("NOOP")
+	c.Send(".")
+	assert.Equal(t, "451 Requested action aborted: local error in processing", c.ReadLine())
+
+	c.Send("NOOP")
+	assert.Equal(t, "250 Ok", c.ReadLine())
+	assert.Equal(t, "", c.ReadLine())
+}
+
+func TestDataStreamWithError(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.Stream(func(msg Message, r io.Reader) error {
+		return errors.New("storage unavailable")
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("MAIL FROM:<john.doe@example.com>")
+	c.Skip(1)
+
+	c.Send("RCPT TO:<jane.doe@example.org>")
+	c.Skip(1)
+
+	c.Send("DATA")
+	c.Skip(1)
+
+	c.Send("not read by the handler")
+	c.Send(".")
+	assert.Equal(t, c.ReadLine(), "451 Requested action aborted: local error in processing")
+
+	c.Send("NOOP")
+	assert.Equal(t, c.ReadLine(), "250 Ok")
+}
+
+func TestDataWithReceived(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.AddReceived = true
+	s.AddReturnPath = true
+	s.Resolver = TestResolver{Addrs: map[string][]string{
+		"127.0.0.1": {"client.example.com."},
+	}}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	reply := c.SendMessage("john.doe@example.com", "jane.doe@example.org", "hello")
+	assert.Regexp(t, QUEUED, reply)
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, "250 2.0.0 Ok: queued as "+msg.ID, reply)
+		assert.Regexp(t, regexp.MustCompile(`^Return-Path: <john\.doe@example\.com>\n`+
+			`Received: from local\.test \(client\.example\.com \[127\.0\.0\.1\]\)\n`+
+			`\tby mx\.test\.server with ESMTP id `+msg.ID+`\n`+
+			`\tfor <jane\.doe@example\.org>; \w{3}, \d{2} \w{3} \d{4} \d{2}:\d{2}:\d{2} [+-]\d{4}\n`+
+			`hello\n$`), string(msg.Data))
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestDataWithQueueID(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.QueueID = func() string {
+		return "ABC123"
+	}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Equal(t, "250 2.0.0 Ok: queued as ABC123",
+		c.SendMessage("john.doe@example.com", "jane.doe@example.org", "hello"))
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, "ABC123", msg.ID)
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
+func TestNewQueueID(t *testing.T) {
+	last := NewQueueID()
+	for i := 0; i < 1000; i++ {
+		id := NewQueueID()
+		assert.Equal(t, 16, len(id))
+		assert.True(t, id > last, id+" should sort after "+last)
+		last = id
+	}
+}
+
+func TestDataWithTooManyHops(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
 	defer s.Close()
 
+	s.MaxHops = 2
+
+	StartServer(t, s)
+
 	c := NewClient(t)
 
 	c.Send("EHLO local.test")
 	c.Skip(2)
 
-	c.Send("MAIL FROM:<john.doe@example.com>")
-	c.Skip(1)
+	assert.Equal(t, "554 5.4.6 Too many hops", c.SendMessage("john.doe@example.com", "jane.doe@example.org",
+		"Received: from a by b\r\nDelivered-To: jane.doe@example.org\r\nreceived: from c\r\n\tby d\r\n\r\nhello"))
 
-	c.Send("RCPT TO:<jane.doe@example.org>")
-	c.Skip(1)
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org",
+		"Received: from a by b\r\nReceived: from c by d\r\n\r\nReceived: in the body"))
+	<-ch
+}
 
-	c.Send("DATA")
-	assert.Equal(t, c.ReadLine(), "354 End data with <CRLF>.<CRLF>")
+func TestDataStreamWithTooManyHops(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
 
-	c.Send(".")
-	assert.Equal(t, c.ReadLine(), "250 Ok")
+	s.MaxHops = 1
+
+	bodies := make(chan []byte, 1)
+	s.Stream(func(msg Message, r io.Reader) error {
+		body, err := io.ReadAll(r)
+		bodies <- body
+		return err
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Equal(t, "554 5.4.6 Too many hops", c.SendMessage("john.doe@example.com", "jane.doe@example.org",
+		"Received: from a by b\r\nReceived: from c by d\r\n\r\nhello"))
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org",
+		"Received: from a by b\r\n\r\nhello"))
+	assert.Equal(t, []byte("Received: from a by b\n\nhello\n"), <-bodies)
+}
+
+func TestDataWithFullQueue(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.QueueSize = 1
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s.Handle(func(msg Message) {
+		started <- struct{}{}
+		<-release
+	})
+	defer close(release)
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "one"))
+	<-started
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "two"))
+	assert.Equal(t, "451 Requested action aborted: server busy, try again later",
+		c.SendMessage("john.doe@example.com", "jane.doe@example.org", "three"))
+}
+
+func TestCloseHandlesQueuedMessages(t *testing.T) {
+	s := NewUnstartedServer(t)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	var mu sync.Mutex
+	var handled []string
+	s.Handle(func(msg Message) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+
+		mu.Lock()
+		handled = append(handled, string(msg.Data))
+		mu.Unlock()
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "one"))
+	<-started
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "two"))
+
+	go func() {
+		time.Sleep(TIMEOUT)
+		close(release)
+	}()
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"one\n", "two\n"}, handled)
+
+	assert.Equal(t, "451 Requested action aborted: server busy, try again later",
+		c.SendMessage("john.doe@example.com", "jane.doe@example.org", "three"))
+}
+
+func TestDataWithWorkers(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.Workers = 2
+
+	release := make(chan struct{})
+	s.Handle(func(msg Message) {
+		if string(msg.Data) == "slow\n" {
+			<-release
+		}
+	})
+	defer close(release)
+
+	ch := make(chan Message, 1)
+	s.Handle(func(msg Message) {
+		ch <- msg
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "slow"))
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "fast"))
 
 	select {
 	case msg := <-ch:
-		assert.Equal(t, "john.doe@example.com", msg.Sender)
-		if assert.Equal(t, 1, len(msg.Recipients)) {
-			assert.Equal(t, "jane.doe@example.org", msg.Recipients[0])
-		}
-		assert.Equal(t, []byte{}, msg.Data)
-	case <-time.After(TIMEOUT):
+		assert.Equal(t, []byte("fast\n"), msg.Data)
+	case <-time.After(time.Second):
 		t.Log("timed out")
 		t.Fail()
 	}
 }
 
-func TestDataWithoutRcpt(t *testing.T) {
-	s, ch := NewCatchServer(t)
+func TestDataWithPanickingHandler(t *testing.T) {
+	s := NewUnstartedServer(t)
 	defer s.Close()
 
+	errs := make(chan error, 2)
+	s.ErrorHook = func(err error) {
+		errs <- err
+	}
+
+	s.Handle(func(msg Message) {
+		panic("oops")
+	})
+
+	ch := make(chan Message, 2)
+	s.Handle(func(msg Message) {
+		ch <- msg
+	})
+
+	StartServer(t, s)
+
 	c := NewClient(t)
 
 	c.Send("EHLO local.test")
 	c.Skip(2)
 
-	c.Send("MAIL FROM:<john.doe@example.com>")
-	c.Skip(1)
+	for _, body := range []string{"one", "two"} {
+		assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", body))
 
-	c.Send("DATA")
-	assert.Equal(t, c.ReadLine(), "503 Command out of sequence")
+		select {
+		case msg := <-ch:
+			assert.Equal(t, []byte(body+"\n"), msg.Data)
+		case <-time.After(time.Second):
+			t.Log("timed out")
+			t.Fail()
+		}
 
-	select {
-	case <-ch:
-	  t.Log("Should not have got a message")
-  case <-time.After(TIMEOUT):
+		err := <-errs
+		if perr, ok := err.(*PanicError); assert.True(t, ok) {
+			assert.Equal(t, "oops", perr.Value)
+			assert.True(t, len(perr.Stack) > 0)
+		}
+	}
+}
+
+func TestDataStreamWithPanic(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	errs := make(chan error, 1)
+	s.ErrorHook = func(err error) {
+		errs <- err
 	}
+
+	s.Stream(func(msg Message, r io.Reader) error {
+		panic("oops")
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Equal(t, "451 Requested action aborted: local error in processing",
+		c.SendMessage("john.doe@example.com", "jane.doe@example.org", "hey"))
+
+	c.Send("NOOP")
+	assert.Equal(t, c.ReadLine(), "250 Ok")
+
+	_, ok := (<-errs).(*PanicError)
+	assert.True(t, ok)
 }
 
 // RSET
@@ -610,7 +2307,7 @@ func TestRset(t *testing.T) {
 
 	c.Send("that was it")
 	c.Send(".")
-	assert.Equal(t, c.ReadLine(), "250 Ok")
+	assert.Regexp(t, QUEUED, c.ReadLine())
 
 	select {
 	case msg := <-ch:
@@ -661,6 +2358,38 @@ func TestVrfyWithImplementation(t *testing.T) {
 	assert.Equal(t, c.ReadLine(), "252 Cannot VRFY user, but will attempt delivery")
 }
 
+func TestVrfyWithPanic(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	errs := make(chan error, 1)
+	s.ErrorHook = func(err error) {
+		errs <- err
+	}
+
+	s.Verify(func(addr string) User {
+		panic("oops")
+	})
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("VRFY john.doe@example.com")
+	assert.Equal(t, c.ReadLine(), "451 Requested action aborted: local error in processing")
+	assert.True(t, c.ReadClosed())
+
+	select {
+	case err := <-errs:
+		if perr, ok := err.(*PanicError); assert.True(t, ok) {
+			assert.Equal(t, "oops", perr.Value)
+		}
+	case <-time.After(TIMEOUT):
+		t.Log("timed out")
+		t.Fail()
+	}
+}
+
 // EXPN
 
 func TestExpn(t *testing.T) {
@@ -813,3 +2542,222 @@ func TestAuthWithWrongSecret(t *testing.T) {
 	c.Send("MAIL FROM:<john.doe@example.com>")
 	assert.True(t, c.ReadClosed())
 }
+
+func TestAuthWithLimiter(t *testing.T) {
+	const (
+		username = "john.doe@example.com"
+		secret = "chicken"
+	)
+
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	s.CramAuthenticator = func(user string) string {
+		if user == username {
+			return secret
+		}
+
+		return ""
+	}
+
+	var mu sync.Mutex
+	var events []AuthEventType
+	s.AuthLimiter = &AuthLimiter{
+		MaxFailures: 2,
+		OnEvent: func(event AuthEvent) {
+			mu.Lock()
+			events = append(events, event.Type)
+			mu.Unlock()
+		},
+	}
+
+	StartServer(t, s)
+
+	auth := func(secret string) string {
+		c := NewClient(t)
+
+		c.Send("EHLO local.test")
+		c.Skip(2)
+
+		c.Send("AUTH CRAM-MD5")
+
+		resp := c.ReadLine()
+		parts := strings.Split(resp, " ")
+		if parts[0] != "334" {
+			return resp
+		}
+
+		e, _ := base64.StdEncoding.DecodeString(parts[1])
+		d := hmac.New(md5.New, []byte(secret))
+		d.Write(e)
+		c.Send("%s %x", username, d.Sum(make([]byte, 0, d.Size())))
+
+		return c.ReadLine()
+	}
+
+	assert.Equal(t, "235 Authentication successful", auth(secret))
+	assert.Equal(t, "535 Authentication credentials invalid", auth("cat"))
+	assert.Equal(t, "535 Authentication credentials invalid", auth("dog"))
+	assert.Equal(t, "454 4.7.0 Temporary authentication failure, try again later", auth(secret))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []AuthEventType{AuthSucceeded, AuthFailed, AuthLockedOut, AuthRefused}, events)
+}
+
+// Logging
+
+func TestLogging(t *testing.T) {
+	s := NewUnstartedServer(t)
+	defer s.Close()
+
+	var buf LogBuffer
+	s.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s.RedactAuth = true
+	s.CramAuthenticator = func(user string) string {
+		return "secret"
+	}
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	c.Send("AUTH CRAM-MD5")
+	c.Skip(1)
+
+	c.Send("john.doe@example.com 0123456789abcdef")
+	c.Skip(1)
+	assert.True(t, c.ReadClosed())
+
+	logs := buf.String()
+	assert.Contains(t, logs, "msg=\"session start\"")
+	assert.Contains(t, logs, "msg=\"session end\"")
+	assert.Contains(t, logs, "helo=local.test line=\"AUTH [redacted]\"")
+	assert.Contains(t, logs, "line=[redacted]")
+	assert.Contains(t, logs, "line=\"250 8BITMIME\"")
+	assert.NotContains(t, logs, "0123456789abcdef")
+}
+
+// Metrics
+
+func TestMetrics(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	s.Metrics = NewMetrics()
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "hello"))
+	<-ch
+
+	c.Send("LOOK")
+	c.Skip(1)
+
+	rec := httptest.NewRecorder()
+	s.Metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE smtp_connections_total counter\nsmtp_connections_total 1\n")
+	assert.Contains(t, body, "smtp_connections_active 1\n")
+	assert.Contains(t, body, "smtp_commands_total{command=\"EHLO\"} 1\n")
+	assert.Contains(t, body, "smtp_commands_total{command=\"DATA\"} 1\n")
+	assert.Contains(t, body, "smtp_commands_total{command=\"unknown\"} 1\n")
+	assert.Contains(t, body, "smtp_messages_total{result=\"accepted\"} 1\n")
+	assert.Contains(t, body, "smtp_received_bytes_total 6\n")
+	assert.Contains(t, body, "# TYPE smtp_handler_duration_seconds histogram\n")
+	assert.Contains(t, body, "smtp_handler_duration_seconds_bucket{le=\"+Inf\"} ")
+}
+
+func TestMetricsWhenNil(t *testing.T) {
+	var m *Metrics
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "", rec.Body.String())
+}
+
+// Tracing
+
+func TestTraceHooks(t *testing.T) {
+	s, ch := NewUnstartedCatchServer(t)
+	defer s.Close()
+
+	tracer := NewMemoryTracer()
+	s.Hooks = TraceHooks(tracer)
+
+	StartServer(t, s)
+
+	c := NewClient(t)
+
+	c.Send("EHLO local.test")
+	c.Skip(2)
+
+	assert.Regexp(t, QUEUED, c.SendMessage("john.doe@example.com", "jane.doe@example.org", "hello"))
+	<-ch
+
+	c.Send("QUIT")
+	c.Skip(1)
+	c.ReadClosed()
+
+	find := func(name string) (MemorySpan, bool) {
+		for _, span := range tracer.Spans() {
+			if span.Name == name {
+				return span, true
+			}
+		}
+		return MemorySpan{}, false
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		session, _ := find("smtp.session")
+		handle, _ := find("smtp.handle")
+		if session.Ended && handle.Ended || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	session, ok := find("smtp.session")
+	if assert.True(t, ok) {
+		assert.True(t, session.Ended)
+		assert.Equal(t, 0, session.ParentID)
+		assert.Equal(t, []string{"220 " + NAME}, session.Events)
+	}
+
+	ehlo, ok := find("smtp.command EHLO")
+	if assert.True(t, ok) {
+		assert.Equal(t, session.ID, ehlo.ParentID)
+		assert.Equal(t, 250, ehlo.Attributes["smtp.reply_code"])
+		assert.Equal(t, 2, len(ehlo.Events))
+	}
+
+	data, ok := find("smtp.command DATA")
+	if assert.True(t, ok) {
+		if assert.Equal(t, 2, len(data.Events)) {
+			assert.Equal(t, "354 End data with <CRLF>.<CRLF>", data.Events[0])
+			assert.Regexp(t, QUEUED, data.Events[1])
+		}
+		assert.True(t, data.Ended)
+	}
+
+	handle, ok := find("smtp.handle")
+	if assert.True(t, ok) {
+		assert.Equal(t, session.ID, handle.ParentID)
+		assert.Equal(t, "john.doe@example.com", handle.Attributes["smtp.sender"])
+		assert.True(t, handle.Ended)
+	}
+}
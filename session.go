@@ -0,0 +1,122 @@
+package smtp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// session holds the state of a single client connection that is not part of a
+// mail transaction.
+type session struct {
+	id         string
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	helo       string
+	heloValid  bool
+	extended   bool
+	tls        bool
+	user       string
+	trusted    bool
+	redactAuth bool
+
+	rdns     string
+	rdnsDone bool
+	fcrdns   string
+
+	sender  string
+	spf     spfCheck
+	heloSPF spfCheck
+
+	listings       []Listing
+	senderListings []Listing
+
+	tarpit *Tarpit
+	errors int
+
+	base   *slog.Logger
+	logger *slog.Logger
+
+	hooks   Hooks
+	ctx     context.Context
+	started time.Time
+	lastCmd time.Time
+}
+
+func (s *Server) newSession(conn net.Conn) *session {
+	now := time.Now()
+	remoteAddr := conn.RemoteAddr()
+	_, isTLS := conn.(*tls.Conn)
+
+	sess := &session{
+		id:         newSessionID(),
+		remoteAddr: remoteAddr,
+		localAddr:  conn.LocalAddr(),
+		tls:        isTLS,
+		redactAuth: s.RedactAuth,
+		tarpit:     s.Tarpit,
+		base:       s.logger(),
+		hooks:      s.Hooks,
+		ctx:        context.Background(),
+		started:    now,
+		lastCmd:    now,
+	}
+	sess.setHelo("", false)
+
+	if sess.hooks != nil {
+		sess.ctx = sess.hooks.OnConnect(sess.ctx, sess.id, remoteAddr)
+	}
+
+	return sess
+}
+
+// setHelo records the name the client gave in HELO or EHLO, and whether it was
+// EHLO.
+func (sess *session) setHelo(name string, extended bool) {
+	sess.helo = name
+	sess.extended = extended
+	sess.heloSPF = spfCheck{}
+
+	remote := ""
+	if sess.remoteAddr != nil {
+		remote = sess.remoteAddr.String()
+	}
+
+	sess.logger = sess.base.With(
+		slog.String("session", sess.id),
+		slog.String("remote", remote),
+		slog.String("helo", name))
+}
+
+// command records that a command has been received.
+func (sess *session) command(cmd, args string) {
+	sess.lastCmd = time.Now()
+
+	if sess.hooks != nil {
+		sess.hooks.OnCommand(sess.ctx, cmd, args)
+	}
+}
+
+// reply records that a line has been sent to the client.
+func (sess *session) reply(line string) {
+	if sess.hooks != nil {
+		sess.hooks.OnReply(sess.ctx, line, time.Since(sess.lastCmd))
+	}
+}
+
+// close records that the connection has been closed.
+func (sess *session) close() {
+	if sess.hooks != nil {
+		sess.hooks.OnDisconnect(sess.ctx, time.Since(sess.started))
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
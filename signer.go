@@ -0,0 +1,147 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Canonicalization is a DKIM canonicalization algorithm, from RFC 6376
+// section 3.4.
+type Canonicalization string
+
+const (
+	Simple  Canonicalization = "simple"
+	Relaxed Canonicalization = "relaxed"
+)
+
+// A Signer adds DKIM signatures, as described in RFC 6376, to messages such as
+// those generated or forwarded by a Handler.
+type Signer struct {
+	// Domain and Selector give the d= and s= tags of the signature, the public
+	// key must be published at Selector._domainkey.Domain.
+	Domain   string
+	Selector string
+
+	// Key is an *rsa.PrivateKey or an ed25519.PrivateKey, as returned by
+	// ParseSigningKey.
+	Key crypto.Signer
+
+	// Headers lists the fields to sign, any not in the message are skipped. It
+	// must include From. A name given twice also prevents more of that field
+	// being added without breaking the signature. If nil a default list is
+	// used.
+	Headers []string
+
+	// HeaderCanonicalization and BodyCanonicalization are the canonicalization
+	// algorithms to use. If empty Relaxed is used.
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+}
+
+// Sign reads the message from r and returns the DKIM-Signature field to prepend
+// to it, using the same line endings as the message.
+func (s *Signer) Sign(r io.Reader) ([]byte, error) {
+	key := SigningKey{Selector: s.Selector, Key: s.Key}
+	algorithm, err := key.algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	headerRelaxed, err := s.HeaderCanonicalization.relaxed()
+	if err != nil {
+		return nil, err
+	}
+	bodyRelaxed, err := s.BodyCanonicalization.relaxed()
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	eol := lineEnding(br)
+
+	fields, err := readFields(br)
+	if err != nil {
+		return nil, err
+	}
+
+	names := presentFields(fields, s.headers())
+	if !containsFold(names, "From") {
+		return nil, errors.New("dkim: From field not signed")
+	}
+
+	body := newBodyCanonicalizer(bodyRelaxed, -1)
+	if err := canonicalizeBodies(br, []*bodyCanonicalizer{body}); err != nil {
+		return nil, err
+	}
+
+	signature, err := signField(key, "DKIM-Signature", []string{
+		"v=1", "a=" + algorithm,
+		"c=" + string(s.HeaderCanonicalization.orDefault()) + "/" + string(s.BodyCanonicalization.orDefault()),
+		"d=" + s.Domain, "s=" + s.Selector,
+		"t=" + strconv.FormatInt(time.Now().Unix(), 10),
+		"h=" + strings.Join(names, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(body.sum()),
+	}, func(field headerField) []byte {
+		return headerHash(fields, names, field, headerRelaxed)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strings.ReplaceAll(string(signature), "\r\n", eol)), nil
+}
+
+// SignMessage returns msg with a DKIM-Signature field prepended to its Data.
+func (s *Signer) SignMessage(msg Message) (Message, error) {
+	signature, err := s.Sign(bytes.NewReader(msg.Data))
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Data = append(signature, msg.Data...)
+	return msg, nil
+}
+
+func (s *Signer) headers() []string {
+	if s.Headers != nil {
+		return s.Headers
+	}
+
+	return defaultSignedHeaders
+}
+
+func (c Canonicalization) orDefault() Canonicalization {
+	if c == "" {
+		return Relaxed
+	}
+
+	return c
+}
+
+func (c Canonicalization) relaxed() (bool, error) {
+	switch c.orDefault() {
+	case Simple:
+		return false, nil
+	case Relaxed:
+		return true, nil
+	default:
+		return false, fmt.Errorf("dkim: unsupported canonicalization %q", string(c))
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unsignedMessage is dkimMessage without its signatures.
+var unsignedMessage = dkimMessage[strings.Index(dkimMessage, "From:"):]
+
+func TestSigner(t *testing.T) {
+	// The key from RFC 8463 Appendix A.
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	der, _ := x509.MarshalPKCS8PrivateKey(ed25519.NewKeyFromSeed(seed))
+
+	key, err := ParseSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.Nil(t, err)
+
+	signer := &Signer{Domain: "football.example.com", Selector: "brisbane", Key: key}
+
+	signature, err := signer.Sign(strings.NewReader(unsignedMessage))
+	assert.Nil(t, err)
+	assert.Regexp(t, `^DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\n`+
+		`\td=football.example.com; s=brisbane; t=\d+;\n`+
+		`\th=From:Subject:Date:To:Message-ID;\n`+
+		`\tbh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\n`+
+		`\tb=[A-Za-z0-9+/]+\n\t [A-Za-z0-9+/=]+\n$`, string(signature))
+
+	results, err := VerifyDKIM(context.Background(), dkimResolver, strings.NewReader(string(signature)+unsignedMessage))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMResult{{Status: DKIMPass, Domain: "football.example.com", Selector: "brisbane", Identifier: "@football.example.com"}}, results)
+}
+
+func TestSignerWithSimpleCanonicalization(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+
+	key, err := ParseSigningKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	assert.Nil(t, err)
+
+	signer := &Signer{
+		Domain:                 "example.org",
+		Selector:               "sel",
+		Key:                    key,
+		Headers:                []string{"From", "Subject", "From"},
+		HeaderCanonicalization: Simple,
+		BodyCanonicalization:   Simple,
+	}
+
+	msg, err := signer.SignMessage(Message{Data: []byte(strings.ReplaceAll(unsignedMessage, "\n", "\r\n"))})
+	assert.Nil(t, err)
+	assert.Contains(t, string(msg.Data), "c=simple/simple;")
+	assert.Contains(t, string(msg.Data), "h=From:Subject:From;\r\n")
+
+	resolver := TestResolver{TXT: map[string][]string{
+		"sel._domainkey.example.org": {"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}}
+
+	results, err := VerifyDKIM(context.Background(), resolver, strings.NewReader(string(msg.Data)))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMStatus{DKIMPass}, statuses(results))
+
+	modified := strings.Replace(string(msg.Data), "Subject: Is", "Subject:  Is", 1)
+	results, err = VerifyDKIM(context.Background(), resolver, strings.NewReader(modified))
+	assert.Nil(t, err)
+	assert.Equal(t, []DKIMStatus{DKIMFail}, statuses(results))
+}
+
+func TestSignerWithoutFrom(t *testing.T) {
+	signer := &Signer{
+		Domain:   "example.org",
+		Selector: "sel",
+		Key:      ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+		Headers:  []string{"Subject"},
+	}
+
+	_, err := signer.Sign(strings.NewReader(unsignedMessage))
+	assert.NotNil(t, err)
+}
+
+func TestParseSigningKeyWithInvalidData(t *testing.T) {
+	_, err := ParseSigningKey([]byte("not a key"))
+	assert.NotNil(t, err)
+
+	_, err = ParseSigningKey(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1, 2, 3}}))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,674 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// An SPFResult is the result of evaluating an SPF policy, as defined in RFC 7208
+// section 2.6.
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+	spfMaxNames       = 10
+)
+
+// CheckSPF evaluates the SPF policy for a message from sender, sent by a client
+// at ip which gave the name helo. If sender is empty, as for bounces, the policy
+// for helo is evaluated instead. An error is returned explaining any temperror
+// or permerror result.
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, helo, sender string) (SPFResult, error) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+
+	local, domain := splitAddress(sender)
+	if local == "" {
+		local = "postmaster"
+	}
+
+	c := &spfChecker{
+		ctx:      ctx,
+		resolver: resolver,
+		ip:       ip,
+		helo:     helo,
+		sender:   local + "@" + domain,
+		local:    local,
+		domain:   domain,
+	}
+	if v4 := ip.To4(); v4 != nil {
+		c.ip = v4
+	}
+
+	return c.checkHost(domain, 0)
+}
+
+// splitAddress splits an address into its local-part and domain.
+func splitAddress(addr string) (local, domain string) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return "", addr
+	}
+
+	return addr[:i], addr[i+1:]
+}
+
+type spfChecker struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	helo     string
+
+	sender, local, domain string
+
+	lookups int
+	voids   int
+}
+
+var (
+	errSPFTooManyLookups     = errors.New("spf: too many DNS lookups")
+	errSPFTooManyVoidLookups = errors.New("spf: too many void DNS lookups")
+)
+
+func (c *spfChecker) checkHost(domain string, depth int) (SPFResult, error) {
+	if depth > spfMaxLookups {
+		return SPFPermError, errSPFTooManyLookups
+	}
+
+	if !validDomain(domain) {
+		return SPFNone, nil
+	}
+
+	record, result, err := c.record(domain)
+	if record == "" {
+		return result, err
+	}
+
+	terms := strings.Fields(record)[1:]
+
+	var redirect string
+	seenRedirect, seenExp := false, false
+
+	for _, term := range terms {
+		if name, value, ok := spfModifier(term); ok {
+			switch strings.ToLower(name) {
+			case "redirect":
+				if seenRedirect {
+					return SPFPermError, fmt.Errorf("spf: %s has more than one redirect", domain)
+				}
+				seenRedirect, redirect = true, value
+			case "exp":
+				if seenExp {
+					return SPFPermError, fmt.Errorf("spf: %s has more than one exp", domain)
+				}
+				seenExp = true
+			}
+			continue
+		}
+
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+
+		match, result, err := c.mechanism(domain, term, depth)
+		if err != nil {
+			return result, err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if seenRedirect {
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return SPFPermError, err
+		}
+		if err := c.countLookup(); err != nil {
+			return SPFPermError, err
+		}
+
+		result, err := c.checkHost(target, depth+1)
+		if result == SPFNone {
+			return SPFPermError, fmt.Errorf("spf: redirect to %s which has no policy", target)
+		}
+		return result, err
+	}
+
+	return SPFNeutral, nil
+}
+
+// record finds the SPF record for domain. If there is not exactly one record
+// the result to return is given instead.
+func (c *spfChecker) record(domain string) (string, SPFResult, error) {
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", SPFNone, nil
+		}
+		return "", SPFTempError, err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", SPFNone, nil
+	case 1:
+		return records[0], "", nil
+	default:
+		return "", SPFPermError, fmt.Errorf("spf: %s has more than one record", domain)
+	}
+}
+
+// spfModifier splits a term into its name and value if it is a modifier.
+func spfModifier(term string) (name, value string, ok bool) {
+	i := strings.IndexByte(term, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+
+	name = term[:i]
+	for j, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			j > 0 && (r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')) {
+			return "", "", false
+		}
+	}
+
+	return name, term[i+1:], true
+}
+
+// mechanism reports whether the mechanism matches. If evaluating it causes an
+// error the result to return is given.
+func (c *spfChecker) mechanism(domain, term string, depth int) (bool, SPFResult, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			break
+		}
+		return true, "", nil
+
+	case "include":
+		if !strings.HasPrefix(arg, ":") {
+			break
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err
+		}
+
+		switch result, err := c.checkHost(target, depth+1); result {
+		case SPFPass:
+			return true, "", nil
+		case SPFTempError:
+			return false, SPFTempError, err
+		case SPFPermError, SPFNone:
+			if err == nil {
+				err = fmt.Errorf("spf: include of %s which has no policy", target)
+			}
+			return false, SPFPermError, err
+		default:
+			return false, "", nil
+		}
+
+	case "a":
+		target, cidr4, cidr6, err := c.targetAndCIDR(arg, domain)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err
+		}
+
+		match, found, err := c.matchHost(target, cidr4, cidr6)
+		if err != nil {
+			return false, SPFTempError, err
+		}
+		if !found {
+			if err := c.countVoid(); err != nil {
+				return false, SPFPermError, err
+			}
+		}
+		return match, "", nil
+
+	case "mx":
+		target, cidr4, cidr6, err := c.targetAndCIDR(arg, domain)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err
+		}
+
+		mxs, err := c.resolver.LookupMX(c.ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError, err
+		}
+		if len(mxs) == 0 {
+			if err := c.countVoid(); err != nil {
+				return false, SPFPermError, err
+			}
+			return false, "", nil
+		}
+		if len(mxs) > spfMaxNames {
+			return false, SPFPermError, fmt.Errorf("spf: %s has too many MX records", target)
+		}
+
+		for _, mx := range mxs {
+			match, _, err := c.matchHost(strings.TrimSuffix(mx.Host, "."), cidr4, cidr6)
+			if err != nil {
+				return false, SPFTempError, err
+			}
+			if match {
+				return true, "", nil
+			}
+		}
+		return false, "", nil
+
+	case "ptr":
+		target := domain
+		if arg != "" {
+			if !strings.HasPrefix(arg, ":") {
+				break
+			}
+			var err error
+			if target, err = c.expand(arg[1:], domain); err != nil {
+				return false, SPFPermError, err
+			}
+		}
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err
+		}
+
+		for _, name := range c.validatedNames() {
+			if strings.EqualFold(name, target) || hasSuffixFold(name, "."+target) {
+				return true, "", nil
+			}
+		}
+		return false, "", nil
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			break
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if strings.ToLower(name) == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, SPFPermError, fmt.Errorf("spf: invalid network %q", arg[1:])
+		}
+		if (strings.ToLower(name) == "ip4") != (ipnet.IP.To4() != nil) {
+			return false, SPFPermError, fmt.Errorf("spf: invalid network %q", arg[1:])
+		}
+		return ipnet.Contains(c.ip), "", nil
+
+	case "exists":
+		if !strings.HasPrefix(arg, ":") {
+			break
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err
+		}
+
+		addrs, err := c.resolver.LookupIPAddr(c.ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError, err
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				return true, "", nil
+			}
+		}
+		if err := c.countVoid(); err != nil {
+			return false, SPFPermError, err
+		}
+		return false, "", nil
+	}
+
+	return false, SPFPermError, fmt.Errorf("spf: unknown mechanism %q", term)
+}
+
+// targetAndCIDR parses the optional domain-spec and dual-cidr-length of an a or
+// mx mechanism.
+func (c *spfChecker) targetAndCIDR(arg, domain string) (string, int, int, error) {
+	cidr4, cidr6 := 32, 128
+
+	spec := arg
+	if i := strings.IndexByte(arg, '/'); i >= 0 {
+		spec = arg[:i]
+
+		v4, v6, _ := strings.Cut(arg[i+1:], "//")
+		if strings.HasPrefix(arg[i:], "//") {
+			v4, v6 = "", arg[i+2:]
+		}
+
+		var err error
+		if v4 != "" {
+			if cidr4, err = strconv.Atoi(v4); err != nil || cidr4 < 0 || cidr4 > 32 {
+				return "", 0, 0, fmt.Errorf("spf: invalid cidr length %q", arg)
+			}
+		}
+		if v6 != "" {
+			if cidr6, err = strconv.Atoi(v6); err != nil || cidr6 < 0 || cidr6 > 128 {
+				return "", 0, 0, fmt.Errorf("spf: invalid cidr length %q", arg)
+			}
+		}
+	}
+
+	if spec == "" {
+		return domain, cidr4, cidr6, nil
+	}
+	if !strings.HasPrefix(spec, ":") {
+		return "", 0, 0, fmt.Errorf("spf: invalid domain-spec %q", arg)
+	}
+
+	target, err := c.expand(spec[1:], domain)
+	return target, cidr4, cidr6, err
+}
+
+// matchHost reports whether any address of host, masked to the given lengths,
+// contains the client address, and whether host had any addresses of the same
+// family as the client address.
+func (c *spfChecker) matchHost(host string, cidr4, cidr6 int) (match, found bool, err error) {
+	addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+	if err != nil && !isNotFound(err) {
+		return false, false, err
+	}
+
+	for _, addr := range addrs {
+		if v4 := addr.IP.To4(); v4 != nil {
+			if c.ip.To4() == nil {
+				continue
+			}
+			found = true
+			if v4.Mask(net.CIDRMask(cidr4, 32)).Equal(c.ip.Mask(net.CIDRMask(cidr4, 32))) {
+				return true, true, nil
+			}
+		} else {
+			if c.ip.To4() != nil {
+				continue
+			}
+			found = true
+			if addr.IP.Mask(net.CIDRMask(cidr6, 128)).Equal(c.ip.Mask(net.CIDRMask(cidr6, 128))) {
+				return true, true, nil
+			}
+		}
+	}
+
+	return false, found, nil
+}
+
+// validatedNames returns the names the client address resolves to that also
+// resolve back to the client address.
+func (c *spfChecker) validatedNames() []string {
+	names, err := c.resolver.LookupAddr(c.ctx, c.ip.String())
+	if err != nil {
+		return nil
+	}
+	if len(names) > spfMaxNames {
+		names = names[:spfMaxNames]
+	}
+
+	var validated []string
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+
+		addrs, err := c.resolver.LookupIPAddr(c.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(c.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+
+	return validated
+}
+
+func (c *spfChecker) countLookup() error {
+	c.lookups++
+	if c.lookups > spfMaxLookups {
+		return errSPFTooManyLookups
+	}
+	return nil
+}
+
+func (c *spfChecker) countVoid() error {
+	c.voids++
+	if c.voids > spfMaxVoidLookups {
+		return errSPFTooManyVoidLookups
+	}
+	return nil
+}
+
+// expand expands the macros in a domain-spec, as described in RFC 7208 section
+// 7, truncating the result if it is too long to be a domain name.
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+
+		i++
+		if i >= len(spec) {
+			return "", fmt.Errorf("spf: invalid macro in %q", spec)
+		}
+
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("spf: invalid macro in %q", spec)
+			}
+
+			value, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", fmt.Errorf("spf: invalid macro in %q", spec)
+		}
+	}
+
+	expanded := b.String()
+	for len(expanded) > 253 {
+		i := strings.IndexByte(expanded, '.')
+		if i < 0 {
+			break
+		}
+		expanded = expanded[i+1:]
+	}
+
+	return expanded, nil
+}
+
+// macro expands the body of a single macro, such as "ir" from "%{ir}".
+func (c *spfChecker) macro(body, domain string) (string, error) {
+	if body == "" {
+		return "", fmt.Errorf("spf: empty macro")
+	}
+
+	letter := body[0]
+	rest := body[1:]
+
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = c.local
+	case 'o':
+		value = c.domain
+	case 'd':
+		value = domain
+	case 'i':
+		value = macroIP(c.ip)
+	case 'p':
+		value = "unknown"
+		if names := c.validatedNames(); len(names) > 0 {
+			value = names[0]
+			for _, name := range names {
+				if strings.EqualFold(name, domain) || hasSuffixFold(name, "."+domain) {
+					value = name
+					break
+				}
+			}
+		}
+	case 'v':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = c.helo
+	default:
+		return "", fmt.Errorf("spf: unknown macro letter %q", letter)
+	}
+
+	digits := 0
+	for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+		digits = digits*10 + int(rest[0]-'0')
+		rest = rest[1:]
+		if digits > 128 {
+			return "", fmt.Errorf("spf: invalid macro transformer in %q", body)
+		}
+	}
+
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", fmt.Errorf("spf: invalid macro delimiter in %q", body)
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	value = strings.Join(parts, ".")
+
+	if letter >= 'A' && letter <= 'Z' {
+		value = url.QueryEscape(value)
+	}
+
+	return value, nil
+}
+
+// macroIP formats ip for the "i" macro, IPv6 addresses are given as dotted
+// nibbles.
+func macroIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// validDomain reports whether domain is a fully qualified domain name with valid
+// labels.
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
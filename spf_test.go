@@ -0,0 +1,137 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSPF(t *testing.T) {
+	resolver := TestResolver{
+		TXT: map[string][]string{
+			"none.example":       {"some other record"},
+			"ip4.example":        {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"ip6.example":        {"v=spf1 ip6:2001:db8::/32 -all"},
+			"a.example":          {"v=spf1 a -all"},
+			"acidr.example":      {"v=spf1 a:host.a.example/24 ~all"},
+			"mx.example":         {"v=spf1 mx ?all"},
+			"include.example":    {"v=spf1 include:ip4.example -all"},
+			"badinclude.example": {"v=spf1 include:none.example -all"},
+			"redirect.example":   {"v=spf1 redirect=ip4.example"},
+			"exists.example":     {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"ptr.example":        {"v=spf1 ptr -all"},
+			"two.example":        {"v=spf1 -all", "v=spf1 +all"},
+			"unknown.example":    {"v=spf1 foo:bar -all"},
+			"neutral.example":    {"v=spf1 ip4:203.0.113.1"},
+			"loop.example":       {"v=spf1 include:loop.example -all"},
+			"voids.example":      {"v=spf1 a:x1.void.example a:x2.void.example a:x3.void.example -all"},
+		},
+		IPs: map[string][]string{
+			"a.example":                             {"192.0.2.10", "2001:db8::10"},
+			"host.a.example":                        {"198.51.100.200"},
+			"mail.example":                          {"192.0.2.20"},
+			"ptr.example":                           {"192.0.2.30"},
+			"40.2.0.192.sender._spf.exists.example": {"127.0.0.2"},
+		},
+		MX: map[string][]string{
+			"mx.example": {"mail.example"},
+		},
+		Addrs: map[string][]string{
+			"192.0.2.30": {"ptr.example."},
+		},
+	}
+
+	for _, tc := range []struct {
+		ip, sender string
+		result     SPFResult
+	}{
+		{"192.0.2.1", "user@missing.example", SPFNone},
+		{"192.0.2.1", "user@none.example", SPFNone},
+		{"192.0.2.1", "user@ip4.example", SPFPass},
+		{"198.51.100.1", "user@ip4.example", SPFFail},
+		{"2001:db8::1", "user@ip6.example", SPFPass},
+		{"2001:db9::1", "user@ip6.example", SPFFail},
+		{"192.0.2.10", "user@a.example", SPFPass},
+		{"2001:db8::10", "user@a.example", SPFPass},
+		{"192.0.2.11", "user@a.example", SPFFail},
+		{"198.51.100.1", "user@acidr.example", SPFPass},
+		{"198.51.101.1", "user@acidr.example", SPFSoftFail},
+		{"192.0.2.20", "user@mx.example", SPFPass},
+		{"192.0.2.21", "user@mx.example", SPFNeutral},
+		{"192.0.2.1", "user@include.example", SPFPass},
+		{"198.51.100.1", "user@include.example", SPFFail},
+		{"192.0.2.1", "user@badinclude.example", SPFPermError},
+		{"192.0.2.1", "user@redirect.example", SPFPass},
+		{"198.51.100.1", "user@redirect.example", SPFFail},
+		{"192.0.2.40", "sender-user@exists.example", SPFPass},
+		{"192.0.2.41", "sender-user@exists.example", SPFFail},
+		{"192.0.2.30", "user@ptr.example", SPFPass},
+		{"192.0.2.31", "user@ptr.example", SPFFail},
+		{"192.0.2.1", "user@two.example", SPFPermError},
+		{"192.0.2.1", "user@unknown.example", SPFPermError},
+		{"192.0.2.1", "user@neutral.example", SPFNeutral},
+		{"192.0.2.1", "user@loop.example", SPFPermError},
+		{"192.0.2.1", "user@voids.example", SPFPermError},
+	} {
+		result, _ := CheckSPF(context.Background(), resolver, net.ParseIP(tc.ip), "helo.example", tc.sender)
+		assert.Equal(t, tc.result, result, tc.sender+" from "+tc.ip)
+	}
+}
+
+func TestCheckSPFWithNullSender(t *testing.T) {
+	resolver := TestResolver{TXT: map[string][]string{
+		"helo.example": {"v=spf1 ip4:192.0.2.1 -all"},
+	}}
+
+	result, err := CheckSPF(context.Background(), resolver, net.ParseIP("192.0.2.1"), "helo.example", "")
+	assert.Nil(t, err)
+	assert.Equal(t, SPFPass, result)
+}
+
+func TestSPFMacros(t *testing.T) {
+	c := &spfChecker{
+		ctx:      context.Background(),
+		resolver: TestResolver{},
+		ip:       net.ParseIP("192.0.2.3").To4(),
+		helo:     "mx.example.org",
+		sender:   "strong-bad@email.example.com",
+		local:    "strong-bad",
+		domain:   "email.example.com",
+	}
+
+	// Examples from RFC 7208 section 7.4.
+	for spec, expected := range map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{ir}.%{v}.%{l1r-}.lp.%{d}":        "3.2.0.192.in-addr.strong.lp.email.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"%%%_%-":                            "% %20",
+	} {
+		result, err := c.expand(spec, "email.example.com")
+		assert.Nil(t, err, spec)
+		assert.Equal(t, expected, result, spec)
+	}
+
+	c.ip = net.ParseIP("2001:db8::cb01")
+	result, _ := c.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com")
+	assert.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com", result)
+
+	_, err := c.expand("%{x}", "email.example.com")
+	assert.NotNil(t, err)
+}
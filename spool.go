@@ -0,0 +1,63 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spool buffers a message body in memory until it grows past threshold bytes,
+// at which point the body is moved to a temporary file in dir.
+type spool struct {
+	threshold int64
+	dir       string
+	buf       bytes.Buffer
+	file      *os.File
+}
+
+func newSpool(threshold int64, dir string) *spool {
+	return &spool{threshold: threshold, dir: dir}
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > s.threshold {
+		file, err := os.CreateTemp(s.dir, "smtp-spool-")
+		if err != nil {
+			return 0, err
+		}
+
+		s.file = file
+		if _, err := s.buf.WriteTo(file); err != nil {
+			return 0, err
+		}
+	}
+
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+
+	return s.buf.Write(p)
+}
+
+// Reader returns a reader positioned at the start of the spooled body.
+func (s *spool) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.buf.Bytes()), nil
+	}
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return s.file, nil
+}
+
+// Close releases the spool, removing any temporary file that was created.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
@@ -0,0 +1,85 @@
+package smtp
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTarpitDelay     = time.Second
+	defaultTarpitMaxDelay  = 30 * time.Second
+	defaultTarpitMaxErrors = 20
+)
+
+// A Tarpit slows down clients that make repeated errors, such as giving
+// unknown recipients, sending invalid commands or failing to authenticate, so
+// that they cannot probe the Server quickly. Each permanent (5xx) reply after
+// the first is delayed a little longer than the last, and once a client has
+// made too many errors it is disconnected.
+type Tarpit struct {
+	// Delay is added before each error reply for each error made before it. If
+	// zero it is 1 second.
+	Delay time.Duration
+
+	// MaxDelay is the longest an error reply is delayed. If zero it is 30
+	// seconds.
+	MaxDelay time.Duration
+
+	// MaxErrors is the number of errors after which the client is disconnected
+	// with a 421 reply. If zero it is 20; if negative clients are never
+	// disconnected.
+	MaxErrors int
+}
+
+// delay returns how long to wait before replying to a client's nth error.
+func (t *Tarpit) delay(n int) time.Duration {
+	step := t.Delay
+	if step == 0 {
+		step = defaultTarpitDelay
+	}
+
+	max := t.MaxDelay
+	if max == 0 {
+		max = defaultTarpitMaxDelay
+	}
+
+	if n <= 1 {
+		return 0
+	}
+	if d := step * time.Duration(n-1); time.Duration(n-1) <= max/step && d < max {
+		return d
+	}
+	return max
+}
+
+// exceeded reports whether a client that has made n errors should be
+// disconnected.
+func (t *Tarpit) exceeded(n int) bool {
+	max := t.MaxErrors
+	if max == 0 {
+		max = defaultTarpitMaxErrors
+	}
+
+	return max > 0 && n >= max
+}
+
+// countError records line, about to be sent to the client, if it is an error,
+// waiting before it is sent if the Server tarpits clients.
+func (sess *session) countError(line string) {
+	if sess.tarpit == nil || !strings.HasPrefix(line, "5") {
+		return
+	}
+
+	sess.errors++
+	if d := sess.tarpit.delay(sess.errors); d > 0 {
+		sess.logger.Debug("tarpit", slog.Int("errors", sess.errors), slog.Duration("delay", d))
+		time.Sleep(d)
+	}
+}
+
+// tooManyErrors reports whether the client should be disconnected for making
+// too many errors.
+func (sess *session) tooManyErrors() bool {
+	return sess.tarpit != nil && sess.tarpit.exceeded(sess.errors)
+}
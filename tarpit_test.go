@@ -0,0 +1,28 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTarpitDelay(t *testing.T) {
+	tarpit := &Tarpit{Delay: 2 * time.Second, MaxDelay: 5 * time.Second}
+
+	assert.Equal(t, time.Duration(0), tarpit.delay(1))
+	assert.Equal(t, 2*time.Second, tarpit.delay(2))
+	assert.Equal(t, 4*time.Second, tarpit.delay(3))
+	assert.Equal(t, 5*time.Second, tarpit.delay(4))
+	assert.Equal(t, 5*time.Second, tarpit.delay(1<<40))
+
+	assert.Equal(t, 29*time.Second, (&Tarpit{}).delay(30))
+	assert.Equal(t, 30*time.Second, (&Tarpit{}).delay(31))
+}
+
+func TestTarpitExceeded(t *testing.T) {
+	assert.False(t, (&Tarpit{}).exceeded(19))
+	assert.True(t, (&Tarpit{}).exceeded(20))
+	assert.True(t, (&Tarpit{MaxErrors: 3}).exceeded(3))
+	assert.False(t, (&Tarpit{MaxErrors: -1}).exceeded(1000))
+}
@@ -0,0 +1,221 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Tracer starts Spans, in the style of OpenTelemetry. The Span started should
+// be a child of any Span carried by ctx, and the context returned should carry
+// the new Span.
+type Tracer interface {
+	Start(ctx context.Context, name string, start time.Time) (context.Context, Span)
+}
+
+// A Span is a timed operation started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	AddEvent(name string)
+	RecordError(err error)
+	End()
+}
+
+// TraceHooks returns Hooks that record a span for each session, with a child
+// span for each command and for each Message handled.
+func TraceHooks(tracer Tracer) Hooks {
+	return &traceHooks{tracer: tracer}
+}
+
+type traceHooks struct {
+	tracer Tracer
+}
+
+type traceKey struct{}
+
+// traceSession holds the open spans of a session.
+type traceSession struct {
+	mu      sync.Mutex
+	session Span
+	command Span
+}
+
+func (h *traceHooks) OnConnect(ctx context.Context, sessionID string, remoteAddr net.Addr) context.Context {
+	ctx, span := h.tracer.Start(ctx, "smtp.session", time.Now())
+	span.SetAttribute("smtp.session_id", sessionID)
+	if remoteAddr != nil {
+		span.SetAttribute("net.peer.address", remoteAddr.String())
+	}
+
+	return context.WithValue(ctx, traceKey{}, &traceSession{session: span})
+}
+
+func (h *traceHooks) OnCommand(ctx context.Context, command, args string) {
+	ts, ok := ctx.Value(traceKey{}).(*traceSession)
+	if !ok {
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.command != nil {
+		ts.command.End()
+	}
+
+	_, ts.command = h.tracer.Start(ctx, "smtp.command "+command, time.Now())
+	ts.command.SetAttribute("smtp.command", command)
+}
+
+func (h *traceHooks) OnReply(ctx context.Context, line string, d time.Duration) {
+	ts, ok := ctx.Value(traceKey{}).(*traceSession)
+	if !ok {
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.command == nil {
+		ts.session.AddEvent(line)
+		return
+	}
+
+	ts.command.AddEvent(line)
+
+	// Intermediate lines of a multiline reply, and the 354 reply to DATA, are
+	// followed by further replies to the same command.
+	if len(line) > 3 && line[3] == '-' || len(line) >= 3 && line[:3] == "354" {
+		return
+	}
+
+	if code, err := strconv.Atoi(line[:min(3, len(line))]); err == nil {
+		ts.command.SetAttribute("smtp.reply_code", code)
+	}
+	ts.command.End()
+	ts.command = nil
+}
+
+func (h *traceHooks) OnMessage(ctx context.Context, msg Message, d time.Duration, err error) {
+	_, span := h.tracer.Start(ctx, "smtp.handle", time.Now().Add(-d))
+	span.SetAttribute("smtp.sender", msg.Sender)
+	span.SetAttribute("smtp.recipients", len(msg.Recipients))
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+func (h *traceHooks) OnDisconnect(ctx context.Context, d time.Duration) {
+	ts, ok := ctx.Value(traceKey{}).(*traceSession)
+	if !ok {
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.command != nil {
+		ts.command.End()
+		ts.command = nil
+	}
+	ts.session.End()
+}
+
+// A MemoryTracer is a Tracer that keeps the Spans it starts in memory, for use
+// in tests.
+type MemoryTracer struct {
+	mu    sync.Mutex
+	spans []*memorySpan
+}
+
+// MemorySpan is a record of a Span started by a MemoryTracer. ID starts at 1,
+// a ParentID of 0 means the Span had no parent.
+type MemorySpan struct {
+	ID, ParentID int
+	Name         string
+	Start, End   time.Time
+	Attributes   map[string]interface{}
+	Events       []string
+	Errors       []error
+	Ended        bool
+}
+
+type memorySpanKey struct{}
+
+type memorySpan struct {
+	tracer *MemoryTracer
+	data   MemorySpan
+}
+
+// NewMemoryTracer returns a new MemoryTracer.
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+func (t *MemoryTracer) Start(ctx context.Context, name string, start time.Time) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	span := &memorySpan{tracer: t, data: MemorySpan{
+		ID:         len(t.spans) + 1,
+		Name:       name,
+		Start:      start,
+		Attributes: map[string]interface{}{},
+	}}
+	if parent, ok := ctx.Value(memorySpanKey{}).(*memorySpan); ok {
+		span.data.ParentID = parent.data.ID
+	}
+	t.spans = append(t.spans, span)
+
+	return context.WithValue(ctx, memorySpanKey{}, span), span
+}
+
+// Spans returns a copy of the Spans started so far, in the order they were
+// started.
+func (t *MemoryTracer) Spans() []MemorySpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := make([]MemorySpan, len(t.spans))
+	for i, span := range t.spans {
+		spans[i] = span.data
+		spans[i].Attributes = map[string]interface{}{}
+		for k, v := range span.data.Attributes {
+			spans[i].Attributes[k] = v
+		}
+		spans[i].Events = append([]string(nil), span.data.Events...)
+		spans[i].Errors = append([]error(nil), span.data.Errors...)
+	}
+
+	return spans
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) {
+	s.tracer.mu.Lock()
+	s.data.Attributes[key] = value
+	s.tracer.mu.Unlock()
+}
+
+func (s *memorySpan) AddEvent(name string) {
+	s.tracer.mu.Lock()
+	s.data.Events = append(s.data.Events, name)
+	s.tracer.mu.Unlock()
+}
+
+func (s *memorySpan) RecordError(err error) {
+	s.tracer.mu.Lock()
+	s.data.Errors = append(s.data.Errors, err)
+	s.tracer.mu.Unlock()
+}
+
+func (s *memorySpan) End() {
+	s.tracer.mu.Lock()
+	if !s.data.Ended {
+		s.data.End = time.Now()
+		s.data.Ended = true
+	}
+	s.tracer.mu.Unlock()
+}
@@ -1,9 +1,46 @@
 package smtp
 
+import "context"
+
 type Message struct {
+	// ID uniquely identifies the Message. It is given to the client in the reply
+	// to DATA, and included in any Received header.
+	ID string
+
 	Sender     string
 	Recipients []string
-	Data       []byte
+
+	// Data is the body of the message. Line endings are normalised to LF unless
+	// the Server has RawData set, in which case it is exactly as sent.
+	Data []byte
+
+	// SPF is the result of evaluating the sender's SPF policy, if the Server
+	// verifies SPF.
+	SPF SPFResult
+
+	// DKIM holds the result of verifying each DKIM signature of the Message. It
+	// is nil if the signatures were not verified.
+	DKIM []DKIMResult
+
+	// DMARC is the result of evaluating the DMARC policy of the Message's
+	// author, if the Server verifies DMARC.
+	DMARC DMARCResult
+
+	// ARC is the result of validating the Message's ARC chain, if the Server
+	// verifies ARC.
+	ARC ARCResult
+
+	ctx context.Context
+}
+
+// Context returns the context of the connection the Message was received on,
+// as returned by the Server's Hooks. It is never nil.
+func (m Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+
+	return m.ctx
 }
 
 type transaction interface {
@@ -76,10 +113,12 @@ func (t *recipientsTransaction) Sender(sender string) (transaction, bool) {
 }
 
 func (t *recipientsTransaction) Recipient(recipient string) (transaction, bool) {
-	t.recipients = append(t.recipients, recipient)
-	return t, true
+	// The transaction is copied so that a rejected recipient can be discarded
+	// by keeping the previous one.
+	recipients := append(t.recipients[:len(t.recipients):len(t.recipients)], recipient)
+	return &recipientsTransaction{t.sender, recipients}, true
 }
 
 func (t *recipientsTransaction) Data(data []byte) (Message, bool) {
-	return Message{t.sender, t.recipients, data}, true
+	return Message{Sender: t.sender, Recipients: t.recipients, Data: data}, true
 }